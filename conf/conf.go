@@ -4,9 +4,12 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
+	"github.com/Masterminds/semver"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -19,6 +22,8 @@ type Conf struct {
 	ImportMap map[string]Import `yaml:"-"`
 	confFile  string            `yaml:"-"`
 	yamlType  bool              `yaml:"-"`
+	goMod     *GoMod            `yaml:"-"`
+	dep       *depFile          `yaml:"-"`
 }
 
 type Import struct {
@@ -27,6 +32,50 @@ type Import struct {
 	Repo    string `yaml:"repo,omitempty"`
 	Lock    bool   `yaml:"lock,omitempty"`
 	Options `yaml:",inline"`
+	// Commit pins the import to the commit recorded in trash.lock
+	Commit string `yaml:"-"`
+	// Tag is the tag a version constraint resolved to
+	Tag string `yaml:"-"`
+	// ModVersion is the module version Version stands for, which go.mod gets
+	// when Version isn't one, like a branch or a commit
+	ModVersion string `yaml:"-"`
+}
+
+var constraintAnd = regexp.MustCompile(`([0-9A-Za-z*])\s+([<>=!~^])`)
+
+// ParseConstraint parses version as a semver constraint, like "^1.4",
+// "~2.1.0" or ">=1.2 <2". It's false for tags, commits and branches.
+func ParseConstraint(version string) (*semver.Constraints, bool) {
+	if _, err := semver.NewVersion(version); err == nil {
+		return nil, false
+	}
+	// semver only takes commas between the constraints to satisfy all of
+	ors := strings.Split(constraintAnd.ReplaceAllString(version, "$1,$2"), "||")
+	for k, or := range ors {
+		ands := strings.Split(or, ",")
+		for j, and := range ands {
+			ands[j] = padLessThan(strings.TrimSpace(and))
+		}
+		ors[k] = strings.Join(ands, ",")
+	}
+	c, err := semver.NewConstraint(strings.Join(ors, "||"))
+	return c, err == nil
+}
+
+// padLessThan makes "<2" mean "<2.0.0", as it does everywhere else:
+// Masterminds/semver takes it as anything below 3.0.0.
+func padLessThan(c string) string {
+	if !strings.HasPrefix(c, "<") || strings.HasPrefix(c, "<=") {
+		return c
+	}
+	v := strings.TrimSpace(c[1:])
+	if strings.ContainsAny(v, "xX*-+") {
+		return c
+	}
+	for strings.Count(v, ".") < 2 {
+		v += ".0"
+	}
+	return "<" + v
 }
 
 type Imports []Import
@@ -49,6 +98,10 @@ func (i Imports) Swap(k, j int) {
 type Options struct {
 	Transitive bool `yaml:"transitive,omitempty"`
 	Staging    bool `yaml:"staging,omitempty"`
+	// VCS is the kind of repo the import comes from: git, hg, svn or bzr,
+	// or proxy for a module proxy, with the repo URL being the GOPROXY.
+	// It's detected when empty.
+	VCS string `yaml:"vcs,omitempty"`
 }
 
 type ExportMap struct {
@@ -56,6 +109,13 @@ type ExportMap struct {
 }
 
 func Parse(path string) (*Conf, error) {
+	switch filepath.Base(path) {
+	case "go.mod", "go.sum":
+		return parseGoMod(path)
+	case "Gopkg.toml", "Gopkg.lock":
+		return parseDep(path)
+	}
+
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -131,6 +191,9 @@ func parseOptions(options string) Options {
 	parts := strings.Split(options, ",")
 	for _, part := range parts {
 		kvParts := strings.Split(part, "=")
+		if len(kvParts) > 1 && kvParts[0] == "vcs" {
+			importOptions.VCS = kvParts[1]
+		}
 		if len(kvParts) > 1 && kvParts[1] == "true" {
 			switch kvParts[0] {
 			case "transitive":
@@ -143,6 +206,21 @@ func parseOptions(options string) Options {
 	return importOptions
 }
 
+// flat formats the options the way they're written in a flat config file.
+func (o Options) flat() string {
+	var opts []string
+	if o.Transitive {
+		opts = append(opts, "transitive=true")
+	}
+	if o.Staging {
+		opts = append(opts, "staging=true")
+	}
+	if o.VCS != "" {
+		opts = append(opts, "vcs="+o.VCS)
+	}
+	return strings.Join(opts, ",")
+}
+
 // Dedupe deletes duplicates and sorts the imports
 func (t *Conf) Dedupe() {
 	t.ImportMap = map[string]Import{}
@@ -181,6 +259,13 @@ func (t *Conf) Dump(path string) error {
 	if t.yamlType {
 		return yaml.NewEncoder(file).Encode(t)
 	}
+	// Same goes for go.mod and dep files
+	if t.goMod != nil {
+		return t.modFile().Write(file)
+	}
+	if t.dep != nil {
+		return t.writeDep(file)
+	}
 	// Otherwise create a flat config file
 	w := bufio.NewWriter(file)
 	defer w.Flush()
@@ -191,8 +276,14 @@ func (t *Conf) Dump(path string) error {
 	if len(t.Imports) > 0 {
 		fmt.Fprintln(w, "\n# import")
 		for _, i := range t.Imports {
-			s := fmt.Sprintf("%s\t%s\t%s", i.Package, i.Version, i.Repo)
-			fmt.Fprintln(w, strings.TrimSpace(s))
+			s := fmt.Sprintf("%s\t%s\t%s\t%s", i.Package, i.Version, i.Repo, i.Options.flat())
+			fmt.Fprintln(w, strings.Join(strings.Fields(s), "\t"))
+		}
+	}
+	if len(t.Packages) > 0 {
+		fmt.Fprintln(w, "\n# packages")
+		for _, pkg := range t.Packages {
+			fmt.Fprintln(w, "package="+pkg)
 		}
 	}
 	if len(t.Excludes) > 0 {
@@ -207,3 +298,9 @@ func (t *Conf) Dump(path string) error {
 func (t *Conf) ConfFile() string {
 	return t.confFile
 }
+
+// IsGoMod tells whether the conf was read from go.mod, which only takes
+// module versions: those which aren't need a ModVersion.
+func (t *Conf) IsGoMod() bool {
+	return t.goMod != nil
+}
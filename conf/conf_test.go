@@ -2,6 +2,8 @@ package conf
 
 import (
 	"testing"
+
+	"github.com/Masterminds/semver"
 )
 
 func TestDuplicates(t *testing.T) {
@@ -56,3 +58,57 @@ func TestDuplicates(t *testing.T) {
 	}
 
 }
+
+func TestParseConstraint(t *testing.T) {
+	for _, c := range []struct {
+		version    string
+		constraint bool
+		matches    []string
+		misses     []string
+	}{
+		{"^1.4", true, []string{"v1.4.0", "v1.9.2"}, []string{"v1.3.9", "v2.0.0"}},
+		{"~2.1.0", true, []string{"v2.1.0", "v2.1.7"}, []string{"v2.2.0"}},
+		{">=1.2 <2", true, []string{"v1.2.0", "v1.99.0"}, []string{"v1.1.0", "v2.0.0"}},
+		{">=1.2, <2", true, []string{"v1.2.0"}, []string{"v2.0.0"}},
+		{"1.x", true, []string{"v1.0.0", "v1.5.0"}, []string{"v2.0.0"}},
+		{"<1.5 || ^3", true, []string{"v1.4.9", "v3.1.0"}, []string{"v1.5.0", "v2.0.0"}},
+		{"v1.4.2", false, nil, nil},
+		{"master", false, nil, nil},
+		{"6ec70d6a5542d5c2ad5b6ed1ba0b0e4b5b2e67d4", false, nil, nil},
+	} {
+		constraint, ok := ParseConstraint(c.version)
+		if ok != c.constraint {
+			t.Errorf("ParseConstraint(%q): expected %v, got %v", c.version, c.constraint, ok)
+			continue
+		}
+		for _, v := range c.matches {
+			if !constraint.Check(semver.MustParse(v)) {
+				t.Errorf("%s should match %q", v, c.version)
+			}
+		}
+		for _, v := range c.misses {
+			if constraint.Check(semver.MustParse(v)) {
+				t.Errorf("%s should not match %q", v, c.version)
+			}
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, c := range []struct {
+		options string
+		parsed  Options
+	}{
+		{"transitive=true", Options{Transitive: true}},
+		{"staging=true,vcs=hg", Options{Staging: true, VCS: "hg"}},
+		{"vcs=svn,transitive=false", Options{VCS: "svn"}},
+	} {
+		o := parseOptions(c.options)
+		if o != c.parsed {
+			t.Errorf("parseOptions(%q): expected %+v, got %+v", c.options, c.parsed, o)
+		}
+		if flat := parseOptions(o.flat()); flat != o {
+			t.Errorf("%+v doesn't survive flat(): got %+v", o, flat)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/sirupsen/logrus"
+)
+
+// depProject is a [[constraint]], [[override]] or [[projects]] entry of dep's
+// Gopkg.toml or Gopkg.lock.
+type depProject struct {
+	Name     string
+	Version  string
+	Branch   string
+	Revision string
+	Source   string
+}
+
+// depTable is a [[constraint]] or [[override]] table of a Gopkg.toml.
+type depTable struct {
+	table string
+	// owner tells whether this is the table the version of the project is
+	// set in, rather than a constraint it overrides
+	owner bool
+	depProject
+}
+
+// depFile remembers what a conf parsed from Gopkg.toml or Gopkg.lock looked like.
+type depFile struct {
+	lock     bool
+	branches map[string]string
+	required []string
+	ignored  []string
+
+	// manifest has the tables of a Gopkg.toml, which are written back as
+	// they were unless the versions of their imports are set. With fromLock,
+	// the imports came from the Gopkg.lock next to it instead, and only those
+	// set go in there: never the other projects of the lock.
+	manifest []depTable
+	fromLock bool
+	// edited are the imports whose versions were set since the file was read
+	edited map[string]bool
+	// rest is the text of the other tables of a Gopkg.toml, like [prune]
+	rest string
+}
+
+func depProjects(tables []map[string]interface{}) []depProject {
+	projects := make([]depProject, 0, len(tables))
+	for _, t := range tables {
+		projects = append(projects, depProject{
+			Name:     tomlString(t, "name"),
+			Version:  tomlString(t, "version"),
+			Branch:   tomlString(t, "branch"),
+			Revision: tomlString(t, "revision"),
+			Source:   tomlString(t, "source"),
+		})
+	}
+	return projects
+}
+
+// ref picks what to check out: locks pin revisions, manifests may only
+// say a version or branch. A plain version in a manifest is what dep takes
+// it for, the constraint of the versions compatible with it: "1.4.2" is
+// "^1.4.2", which tag v1.4.2 satisfies too.
+func (p depProject) ref(lock bool) string {
+	if lock && p.Revision != "" {
+		return p.Revision
+	}
+	if _, err := semver.NewVersion(p.Version); err == nil && !lock {
+		return "^" + p.Version
+	}
+	for _, r := range []string{p.Version, p.Branch, p.Revision} {
+		if r != "" {
+			return r
+		}
+	}
+	return ""
+}
+
+// parseDep reads Gopkg.toml or Gopkg.lock. A Gopkg.toml is only a set of
+// constraints, so the Gopkg.lock next to it is used instead when there is one.
+func parseDep(path string) (*Conf, error) {
+	dir := filepath.Dir(path)
+	lockFile := filepath.Join(dir, "Gopkg.lock")
+	isLock := filepath.Base(path) == "Gopkg.lock"
+
+	var manifest map[string]interface{}
+	if !isLock {
+		var err error
+		if manifest, err = parseTOMLFile(path); err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(lockFile); err == nil {
+			logrus.Infof("Using pinned revisions from '%s'", lockFile)
+			isLock = true
+		}
+	}
+
+	trashConf := &Conf{confFile: path, dep: &depFile{lock: filepath.Base(path) == "Gopkg.lock", branches: map[string]string{}, edited: map[string]bool{}}}
+
+	var projects []depProject
+	if isLock {
+		lock, err := parseTOMLFile(lockFile)
+		if err != nil {
+			return nil, err
+		}
+		projects = depProjects(tomlTables(lock, "projects"))
+	}
+	if manifest != nil {
+		trashConf.dep.required = tomlStrings(manifest, "required")
+		trashConf.dep.ignored = tomlStrings(manifest, "ignored")
+		trashConf.Packages = trashConf.dep.required
+		for _, ignored := range trashConf.dep.ignored {
+			if strings.HasSuffix(ignored, "*") {
+				logrus.Debugf("Ignoring wildcard '%s' (in %s)", ignored, path)
+				continue
+			}
+			trashConf.Excludes = append(trashConf.Excludes, ignored)
+		}
+		trashConf.dep.fromLock = isLock
+		owned := map[string]bool{}
+		// overrides come first, so they win when deduping
+		for _, table := range []string{"override", "constraint"} {
+			for _, p := range depProjects(tomlTables(manifest, table)) {
+				trashConf.dep.manifest = append(trashConf.dep.manifest, depTable{table: table, owner: !owned[p.Name], depProject: p})
+				owned[p.Name] = true
+				if !isLock {
+					projects = append(projects, p)
+				}
+			}
+		}
+		rest, err := depRest(path)
+		if err != nil {
+			return nil, err
+		}
+		trashConf.dep.rest = rest
+	}
+
+	for _, p := range projects {
+		if p.Name == "" {
+			return nil, fmt.Errorf("project without a name (in %s)", path)
+		}
+		if p.Branch != "" {
+			trashConf.dep.branches[p.Name] = p.Branch
+		}
+		trashConf.Imports = append(trashConf.Imports, Import{
+			Package: p.Name,
+			Version: p.ref(isLock),
+			Repo:    p.Source,
+		})
+	}
+
+	trashConf.Dedupe()
+	return trashConf, nil
+}
+
+// tomlHeader matches the header of a TOML table.
+var tomlHeader = regexp.MustCompile(`^\s*\[\[?\s*([A-Za-z0-9_.-]+)\s*\]\]?\s*(#.*)?$`)
+
+// depRest returns the text of the tables of a Gopkg.toml other than its
+// constraints and overrides, which trash has no use for but dep does.
+func depRest(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	keep := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if m := tomlHeader.FindStringSubmatch(line); m != nil {
+			keep = m[1] != "constraint" && m[1] != "override"
+		}
+		if keep {
+			rest = append(rest, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(rest, "")), nil
+}
+
+func parseTOMLFile(path string) (map[string]interface{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	t, err := parseTOML(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// writeDep writes the imports back as Gopkg.lock projects, or as the tables
+// of a Gopkg.toml: its own, and constraints for the imports added to it.
+func (t *Conf) writeDep(file *os.File) error {
+	w := bufio.NewWriter(file)
+	defer w.Flush()
+
+	if t.dep.lock {
+		for _, i := range t.Imports {
+			t.writeDepImport(w, "projects", i)
+		}
+		return nil
+	}
+
+	if len(t.dep.required) > 0 {
+		fmt.Fprintf(w, "required = [%s]\n\n", tomlList(t.dep.required))
+	}
+	if len(t.dep.ignored) > 0 {
+		fmt.Fprintf(w, "ignored = [%s]\n\n", tomlList(t.dep.ignored))
+	}
+	inManifest := map[string]bool{}
+	for _, table := range []string{"constraint", "override"} {
+		for _, m := range t.dep.manifest {
+			inManifest[m.Name] = true
+			i, ok := t.Get(m.Name)
+			switch {
+			case m.table != table:
+			case !ok:
+				// removed
+			case m.owner && (!t.dep.fromLock || t.dep.edited[m.Name]):
+				t.writeDepImport(w, table, i)
+			default:
+				writeDepProject(w, table, m.depProject)
+			}
+		}
+	}
+	for _, i := range t.Imports {
+		if !inManifest[i.Package] && (!t.dep.fromLock || t.dep.edited[i.Package]) {
+			t.writeDepImport(w, "constraint", i)
+		}
+	}
+	if t.dep.rest != "" {
+		fmt.Fprintln(w, t.dep.rest)
+	}
+	return nil
+}
+
+func (t *Conf) writeDepImport(w io.Writer, table string, i Import) {
+	p := depProject{Name: i.Package, Source: i.Repo}
+	switch {
+	case t.dep.branches[i.Package] == i.Version:
+		p.Branch = i.Version
+	case isCommit(i.Version):
+		p.Revision = i.Version
+	default:
+		p.Version = depVersion(i.Version)
+	}
+	writeDepProject(w, table, p)
+}
+
+func writeDepProject(w io.Writer, table string, p depProject) {
+	fmt.Fprintf(w, "[[%s]]\n", table)
+	fmt.Fprintf(w, "  name = %q\n", p.Name)
+	for _, kv := range [][2]string{{"branch", p.Branch}, {"revision", p.Revision}, {"version", p.Version}, {"source", p.Source}} {
+		if kv[1] != "" {
+			fmt.Fprintf(w, "  %s = %q\n", kv[0], kv[1])
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+// depVersion is how dep spells version: "^1.4.2" is plain "1.4.2".
+func depVersion(version string) string {
+	if v := strings.TrimPrefix(version, "^"); v != version {
+		if _, err := semver.NewVersion(v); err == nil {
+			return v
+		}
+	}
+	return version
+}
+
+func tomlList(ss []string) string {
+	quoted := make([]string, 0, len(ss))
+	for _, s := range ss {
+		quoted = append(quoted, fmt.Sprintf("%q", s))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func isCommit(version string) bool {
+	return len(version) == 40 && isHex(version)
+}
@@ -0,0 +1,180 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+const testGopkgToml = `# Gopkg.toml example
+required = ["github.com/golang/protobuf/protoc-gen-go"]
+ignored = [
+  "github.com/rancher/trash/hack", # not shipped
+  "github.com/rancher/trash/tools*",
+]
+
+[[constraint]]
+  name = "github.com/sirupsen/logrus"
+  version = "1.4.2"
+  source = "https://github.com/imikushin/logrus.git"
+
+[[constraint]]
+  branch = "master"
+  name = "golang.org/x/sys"
+
+[[override]]
+  name = "golang.org/x/sys"
+  revision = "fde4db37ae7ad8191b03d30d27f258b5291ae4e3"
+
+[prune]
+  go-tests = true
+  unused-packages = true
+`
+
+const testGopkgLock = `# This file is autogenerated, do not edit; changes may be undone by the next 'dep ensure'.
+
+[[projects]]
+  digest = "1:fd8d2a0e6b8a0cd9fd2e8d0d0a43cd0f6e59f69f1c5e2cd6d13c2ddf4e8bd2d0"
+  name = "github.com/sirupsen/logrus"
+  packages = ["."]
+  pruneopts = "UT"
+  revision = "839c75faf7f98a33d445d181f3018b5c3409a45e"
+  source = "https://github.com/imikushin/logrus.git"
+  version = "v1.4.2"
+
+[[projects]]
+  branch = "master"
+  name = "golang.org/x/sys"
+  packages = [
+    "unix",
+    "windows",
+  ]
+  revision = "fde4db37ae7ad8191b03d30d27f258b5291ae4e3"
+
+[solve-meta]
+  analyzer-name = "dep"
+  analyzer-version = 1
+  input-imports = ["github.com/sirupsen/logrus"]
+  solver-name = "gps-cdcl"
+  solver-version = 1
+`
+
+func TestParseTOML(t *testing.T) {
+	assert := require.New(t)
+
+	toml, err := parseTOML(strings.NewReader(testGopkgLock))
+	assert.NoError(err)
+	projects := tomlTables(toml, "projects")
+	assert.Len(projects, 2)
+	assert.Equal("golang.org/x/sys", tomlString(projects[1], "name"))
+	assert.Equal([]string{"unix", "windows"}, tomlStrings(projects[1], "packages"))
+	meta, ok := toml["solve-meta"].(map[string]interface{})
+	assert.True(ok)
+	assert.Equal(int64(1), meta["solver-version"])
+
+	for _, s := range []string{"[[projects]\n", "name = \"foo\n", "packages = [\"a\"\n", "foo"} {
+		_, err := parseTOML(strings.NewReader(s))
+		assert.Error(err, s)
+	}
+}
+
+func TestParseDep(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-dep")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "Gopkg.toml")
+	lock := filepath.Join(dir, "Gopkg.lock")
+	assert.NoError(ioutil.WriteFile(manifest, []byte(testGopkgToml), 0644))
+
+	trashConf, err := Parse(manifest)
+	assert.NoError(err)
+	assert.Equal([]Import{
+		{Package: "github.com/sirupsen/logrus", Version: "^1.4.2", Repo: "https://github.com/imikushin/logrus.git"},
+		{Package: "golang.org/x/sys", Version: "fde4db37ae7ad8191b03d30d27f258b5291ae4e3"},
+	}, trashConf.Imports)
+	assert.Equal([]string{"github.com/golang/protobuf/protoc-gen-go"}, trashConf.Packages)
+	assert.Equal([]string{"github.com/rancher/trash/hack"}, trashConf.Excludes)
+	constraint, ok := ParseConstraint(trashConf.Imports[0].Version)
+	assert.True(ok, "a plain version in the manifest is a constraint")
+	assert.True(constraint.Check(semver.MustParse("v1.4.2")))
+	assert.True(constraint.Check(semver.MustParse("v1.5.0")))
+	assert.False(constraint.Check(semver.MustParse("v2.0.0")))
+
+	// and it's written back as it was
+	out := filepath.Join(dir, "out", "Gopkg.toml")
+	assert.NoError(os.MkdirAll(filepath.Dir(out), 0755))
+	assert.NoError(trashConf.Dump(out))
+	assert.Contains(string(mustRead(t, out)), "version = \"1.4.2\"")
+
+	assert.NoError(ioutil.WriteFile(lock, []byte(testGopkgLock), 0644))
+	for _, f := range []string{manifest, lock} {
+		trashConf, err = Parse(f)
+		assert.NoError(err)
+		assert.Equal([]Import{
+			{Package: "github.com/sirupsen/logrus", Version: "839c75faf7f98a33d445d181f3018b5c3409a45e", Repo: "https://github.com/imikushin/logrus.git"},
+			{Package: "golang.org/x/sys", Version: "fde4db37ae7ad8191b03d30d27f258b5291ae4e3"},
+		}, trashConf.Imports)
+	}
+
+	trashConf.Imports[1].Version = "master"
+	assert.NoError(trashConf.Dump(lock))
+	trashConf, err = Parse(lock)
+	assert.NoError(err)
+	assert.Equal("master", trashConf.Imports[1].Version)
+	assert.Equal("master", trashConf.dep.branches["golang.org/x/sys"])
+}
+
+func TestDumpDepManifestWithLock(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-dep")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	manifest := filepath.Join(dir, "Gopkg.toml")
+	assert.NoError(ioutil.WriteFile(manifest, []byte(testGopkgToml), 0644))
+	// the lock has a transitive project too
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "Gopkg.lock"), []byte(testGopkgLock+`
+[[projects]]
+  name = "github.com/pkg/errors"
+  packages = ["."]
+  revision = "614d223910a179a466c1767a985424175c39b465"
+  version = "v0.9.1"
+`), 0644))
+	withoutLock, err := Parse(manifest)
+	assert.NoError(err)
+	assert.NoError(os.Remove(filepath.Join(dir, "Gopkg.lock")))
+	want, err := Parse(manifest)
+	assert.NoError(err)
+
+	out := filepath.Join(dir, "out", "Gopkg.toml")
+	assert.NoError(os.MkdirAll(filepath.Dir(out), 0755))
+	assert.NoError(withoutLock.Dump(out))
+	dumped := string(mustRead(t, out))
+	assert.Contains(dumped, "version = \"1.4.2\"")
+	assert.Contains(dumped, "[[override]]")
+	assert.Contains(dumped, "[prune]\n  go-tests = true\n  unused-packages = true\n")
+	assert.NotContains(dumped, "github.com/pkg/errors", "the projects of the lock stay out of the manifest")
+	assert.NotContains(dumped, "839c75faf7f98a33d445d181f3018b5c3409a45e")
+	parsed, err := Parse(out)
+	assert.NoError(err)
+	assert.Equal(want.Imports, parsed.Imports)
+	assert.Equal(want.dep.manifest, parsed.dep.manifest)
+
+	// imports which are set or added go in as constraints
+	assert.NoError(withoutLock.SetVersion(out, "github.com/pkg/errors", "v0.9.2", ""))
+	assert.NoError(withoutLock.Add(Import{Package: "github.com/urfave/cli", Version: "v1.22.1"}))
+	assert.NoError(withoutLock.Dump(out))
+	parsed, err = Parse(out)
+	assert.NoError(err)
+	assert.ElementsMatch(append(want.Imports[:2:2],
+		Import{Package: "github.com/pkg/errors", Version: "^v0.9.2"},
+		Import{Package: "github.com/urfave/cli", Version: "^v1.22.1"},
+	), parsed.Imports)
+}
@@ -0,0 +1,305 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetVersion changes the version of an import, and of its line in the conf
+// file, leaving the rest of the file byte-for-byte as it was, and writes the
+// file to path: the conf file at path is patched if there's one already, the
+// one it was read from otherwise. When there is no line to patch (the import
+// is new, or it's a Gopkg.lock) the whole file is dumped.
+// go.mod gets mod, the module version of version, which may be "" when
+// version is one already.
+func (t *Conf) SetVersion(path, pkg, version, mod string) error {
+	i, ok := t.Get(pkg)
+	if !ok {
+		return fmt.Errorf("package '%s' is not in %s", pkg, t.confFile)
+	}
+	i.Version = version
+	i.ModVersion = mod
+	i.Commit = ""
+	if t.dep != nil {
+		t.dep.edited[pkg] = true
+	}
+	if t.goMod != nil {
+		if mod = modVersion(i); mod == "" {
+			return fmt.Errorf("no module version for '%s' at '%s' to write to %s", pkg, version, t.confFile)
+		}
+	}
+	t.set(i)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(t.confFile)
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	var patched bool
+	switch {
+	case t.yamlType:
+		patched = patchYAMLVersion(lines, pkg, version)
+	case t.goMod != nil:
+		patched = patchGoModVersion(lines, t.goMod, pkg, mod)
+	case t.dep != nil:
+		patched = !t.dep.lock && patchDepVersion(lines, pkg, version)
+	default:
+		patched = patchFlatVersion(lines, pkg, version)
+	}
+	if !patched {
+		logrus.Debugf("No line for '%s' to patch in %s, rewriting it", pkg, t.confFile)
+		return t.Dump(path)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+}
+
+// Add adds a new import. Call Dump to write it to the conf file. In go.mod,
+// it's required at its ModVersion, unless its version is a module version.
+func (t *Conf) Add(i Import) error {
+	if _, ok := t.Get(i.Package); ok {
+		return fmt.Errorf("package '%s' is already in %s", i.Package, t.confFile)
+	}
+	t.Imports = append(t.Imports, i)
+	t.Dedupe()
+
+	if t.dep != nil {
+		t.dep.edited[i.Package] = true
+	}
+	if t.goMod != nil {
+		t.goMod.Require = append(t.goMod.Require, ModuleVersion{Path: i.Package, Version: modVersion(i)})
+		if i.Repo != "" && i.Repo != modRepo(i.Package) {
+			r := Replacement{Old: ModuleVersion{Path: i.Package}, New: ModuleVersion{Path: i.Repo}}
+			if !isLocalPath(i.Repo) {
+				r.New = ModuleVersion{Path: strings.TrimPrefix(i.Repo, "https://"), Version: modVersion(i)}
+			}
+			t.goMod.Replace = append(t.goMod.Replace, r)
+		}
+	}
+	return nil
+}
+
+// Remove removes an import, along with the excludes and packages inside of it.
+// Call Dump to write it to the conf file.
+func (t *Conf) Remove(pkg string) error {
+	if _, ok := t.Get(pkg); !ok {
+		return fmt.Errorf("package '%s' is not in %s", pkg, t.confFile)
+	}
+	var imports []Import
+	for _, i := range t.Imports {
+		if i.Package != pkg {
+			imports = append(imports, i)
+		}
+	}
+	t.Imports = imports
+	t.Dedupe()
+	t.Excludes = withoutPackage(t.Excludes, pkg)
+	t.Packages = withoutPackage(t.Packages, pkg)
+
+	if t.goMod != nil {
+		var require []ModuleVersion
+		for _, r := range t.goMod.Require {
+			if r.Path != pkg {
+				require = append(require, r)
+			}
+		}
+		var replace []Replacement
+		for _, r := range t.goMod.Replace {
+			if r.Old.Path != pkg {
+				replace = append(replace, r)
+			}
+		}
+		t.goMod.Require, t.goMod.Replace = require, replace
+	}
+	if t.dep != nil {
+		t.dep.required = withoutPackage(t.dep.required, pkg)
+		t.dep.ignored = withoutPackage(t.dep.ignored, pkg)
+	}
+	return nil
+}
+
+// withoutPackage drops pkg and everything inside of it from paths.
+func withoutPackage(paths []string, pkg string) []string {
+	var r []string
+	for _, p := range paths {
+		if p != pkg && !strings.HasPrefix(p, pkg+"/") {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// set replaces the import with the same package.
+func (t *Conf) set(i Import) {
+	for k := range t.Imports {
+		if t.Imports[k].Package == i.Package {
+			t.Imports[k] = i
+		}
+	}
+	t.ImportMap[i.Package] = i
+}
+
+// replaceField replaces the n-th whitespace separated field of line.
+func replaceField(line string, n int, value string) string {
+	loc := regexp.MustCompile(`\S+`).FindAllStringIndex(line, n+1)
+	if len(loc) <= n {
+		return line
+	}
+	return line[:loc[n][0]] + value + line[loc[n][1]:]
+}
+
+func patchFlatVersion(lines []string, pkg, version string) bool {
+	for k, line := range lines {
+		content := line
+		if commentStart := strings.Index(content, "#"); commentStart >= 0 {
+			content = content[:commentStart]
+		}
+		fields := strings.Fields(content)
+		if len(fields) >= 2 && fields[0] == pkg {
+			lines[k] = replaceField(line, 1, version)
+			return true
+		}
+	}
+	return false
+}
+
+var yamlKey = regexp.MustCompile(`^(\s*(?:-\s+)?)([A-Za-z_]+):\s*(.*?)\s*(#.*)?$`)
+
+func patchYAMLVersion(lines []string, pkg, version string) bool {
+	for k, line := range lines {
+		m := yamlKey.FindStringSubmatch(strings.TrimRight(line, "\n"))
+		if m == nil || m[2] != "package" || strings.Trim(m[3], `"'`) != pkg {
+			continue
+		}
+		indent := strings.Repeat(" ", len(m[1]))
+		for j := k + 1; j < len(lines); j++ {
+			n := yamlKey.FindStringSubmatch(strings.TrimRight(lines[j], "\n"))
+			if n == nil {
+				continue
+			}
+			if len(n[1]) != len(indent) || strings.Contains(n[1], "-") {
+				break // next import, or out of the list
+			}
+			if n[2] == "version" {
+				loc := strings.Index(lines[j], ":") + 1
+				rest := lines[j][loc:]
+				if value := strings.TrimSpace(strings.SplitN(rest, "#", 2)[0]); value != "" {
+					lines[j] = lines[j][:loc] + strings.Replace(rest, value, version, 1)
+				} else {
+					lines[j] = lines[j][:loc] + " " + version + "\n"
+				}
+				return true
+			}
+		}
+		lines[k] += indent + "version: " + version + "\n"
+		return true
+	}
+	return false
+}
+
+func patchGoModVersion(lines []string, m *GoMod, pkg, version string) bool {
+	verb := "require"
+	for _, r := range m.Replace {
+		if r.Old.Path == pkg && r.New.Version != "" {
+			verb = "replace" // the version to change is the one of the replacement
+		}
+	}
+	block := ""
+	for k, line := range lines {
+		fields, err := modFields(strings.SplitN(line, "//", 2)[0])
+		if err != nil || len(fields) == 0 {
+			continue
+		}
+		if block == "" {
+			if len(fields) == 2 && fields[1] == "(" {
+				block = fields[0]
+				continue
+			}
+			if fields[0] != verb {
+				continue
+			}
+			fields = fields[1:]
+		} else if fields[0] == ")" {
+			block = ""
+			continue
+		} else if block != verb {
+			continue
+		}
+		// the index of the version field on the line, counting the verb
+		offset := 0
+		if block == "" {
+			offset = 1
+		}
+		switch {
+		case verb == "require" && len(fields) == 2 && fields[0] == pkg:
+			lines[k] = replaceField(line, offset+1, version)
+			return true
+		case verb == "replace" && fields[0] == pkg && len(fields) >= 3 && fields[len(fields)-2] != "=>":
+			lines[k] = replaceField(line, offset+len(fields)-1, version)
+			return true
+		}
+	}
+	return false
+}
+
+var tomlKey = regexp.MustCompile(`^(\s*)(name|version|branch|revision)\s*=\s*"([^"]*)"`)
+
+// patchDepVersion sets the version of pkg in its table: its override if it
+// has one, since that's the one which counts, or else its constraint.
+func patchDepVersion(lines []string, pkg, version string) bool {
+	return patchDepTable(lines, "override", pkg, version) || patchDepTable(lines, "constraint", pkg, version)
+}
+
+func patchDepTable(lines []string, table, pkg, version string) bool {
+	key := "version"
+	if isCommit(version) {
+		key = "revision"
+	}
+	start := -1
+	for k, line := range lines {
+		if m := tomlHeader.FindStringSubmatch(line); m != nil {
+			// not [[prune.project]] or the like, which have names too
+			start = -1
+			if m[1] == table {
+				start = k
+			}
+			continue
+		}
+		if m := tomlKey.FindStringSubmatch(line); m != nil && m[2] == "name" && m[3] == pkg && start >= 0 {
+			// found the table: drop every ref in it and put the new one in place of the first
+			end := len(lines)
+			for j := start + 1; j < len(lines); j++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[j]), "[") {
+					end = j
+					break
+				}
+			}
+			placed := false
+			for j := start + 1; j < end; j++ {
+				n := tomlKey.FindStringSubmatch(lines[j])
+				if n == nil || n[2] == "name" {
+					continue
+				}
+				if placed {
+					lines[j] = ""
+					continue
+				}
+				lines[j] = fmt.Sprintf("%s%s = %q\n", n[1], key, depVersion(version))
+				placed = true
+			}
+			if !placed {
+				lines[k] += fmt.Sprintf("%s%s = %q\n", m[1], key, depVersion(version))
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trash-edit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		file, before, after string
+	}{
+		{
+			"vendor.conf",
+			"github.com/rancher/trash\n\n# logging\ngithub.com/sirupsen/logrus   v1.4.2  # pinned\ngithub.com/pkg/errors        v0.8.1\n",
+			"github.com/rancher/trash\n\n# logging\ngithub.com/sirupsen/logrus   v1.4.2  # pinned\ngithub.com/pkg/errors        v0.9.1\n",
+		},
+		{
+			"trash.yaml",
+			"package: github.com/rancher/trash\nimport:\n- package: github.com/pkg/errors   # errors\n  version: v0.8.1      # pinned\n- package: github.com/sirupsen/logrus\n  version: v1.4.2\n",
+			"package: github.com/rancher/trash\nimport:\n- package: github.com/pkg/errors   # errors\n  version: v0.9.1      # pinned\n- package: github.com/sirupsen/logrus\n  version: v1.4.2\n",
+		},
+		{
+			"go.mod",
+			"module github.com/rancher/trash\n\nrequire (\n\tgithub.com/pkg/errors v0.8.1 // indirect\n\tgithub.com/sirupsen/logrus v1.4.2\n)\n",
+			"module github.com/rancher/trash\n\nrequire (\n\tgithub.com/pkg/errors v0.9.1 // indirect\n\tgithub.com/sirupsen/logrus v1.4.2\n)\n",
+		},
+		{
+			"Gopkg.toml",
+			"[[constraint]]\n  name = \"github.com/pkg/errors\"\n  branch = \"master\"\n  revision = \"abc\"\n\n[[constraint]]\n  name = \"github.com/sirupsen/logrus\"\n  version = \"1.4.2\"\n",
+			"[[constraint]]\n  name = \"github.com/pkg/errors\"\n  version = \"v0.9.1\"\n\n[[constraint]]\n  name = \"github.com/sirupsen/logrus\"\n  version = \"1.4.2\"\n",
+		},
+	} {
+		sub := filepath.Join(dir, c.file+".d")
+		require.NoError(t, os.MkdirAll(sub, 0755))
+		path := filepath.Join(sub, c.file)
+		require.NoError(t, ioutil.WriteFile(path, []byte(c.before), 0644))
+
+		trashConf, err := Parse(path)
+		require.NoError(t, err, c.file)
+		require.NoError(t, trashConf.SetVersion(path, "github.com/pkg/errors", "v0.9.1", ""), c.file)
+		require.Equal(t, c.after, string(mustRead(t, path)), c.file)
+		i, _ := trashConf.Get("github.com/pkg/errors")
+		require.Equal(t, "v0.9.1", i.Version)
+
+		require.Error(t, trashConf.SetVersion(path, "github.com/urfave/cli", "v1.0.0", ""))
+	}
+}
+
+func TestSetVersionPath(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-edit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path, out := filepath.Join(dir, "vendor.conf"), filepath.Join(dir, "out.conf")
+	before := "github.com/rancher/trash\ngithub.com/pkg/errors v0.8.1 # pinned\ngithub.com/sirupsen/logrus v1.4.2\n"
+	assert.NoError(ioutil.WriteFile(path, []byte(before), 0644))
+
+	trashConf, err := Parse(path)
+	assert.NoError(err)
+	assert.NoError(trashConf.SetVersion(out, "github.com/pkg/errors", "v0.9.1", ""))
+	assert.NoError(trashConf.SetVersion(out, "github.com/sirupsen/logrus", "v1.5.0", ""))
+	assert.Equal(before, string(mustRead(t, path)))
+	assert.Equal("github.com/rancher/trash\ngithub.com/pkg/errors v0.9.1 # pinned\ngithub.com/sirupsen/logrus v1.5.0\n", string(mustRead(t, out)))
+}
+
+func TestSetVersionGoModReplace(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-edit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "go.mod")
+	assert.NoError(ioutil.WriteFile(path, []byte("module foo\n\nrequire github.com/sirupsen/logrus v1.4.2\n\nreplace github.com/sirupsen/logrus => github.com/imikushin/logrus v1.4.3\n"), 0644))
+
+	trashConf, err := Parse(path)
+	assert.NoError(err)
+	assert.NoError(trashConf.SetVersion(path, "github.com/sirupsen/logrus", "v1.5.0", ""))
+	assert.Equal("module foo\n\nrequire github.com/sirupsen/logrus v1.4.2\n\nreplace github.com/sirupsen/logrus => github.com/imikushin/logrus v1.5.0\n", string(mustRead(t, path)))
+}
+
+func TestSetVersionGoModRef(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-edit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "go.mod")
+	assert.NoError(ioutil.WriteFile(path, []byte("module foo\n\nrequire (\n\tgithub.com/pkg/errors v0.8.1\n\tgithub.com/sirupsen/logrus v1.4.2\n)\n\nreplace github.com/sirupsen/logrus => github.com/imikushin/logrus v1.4.3\n"), 0644))
+
+	trashConf, err := Parse(path)
+	assert.NoError(err)
+	assert.Error(trashConf.SetVersion(path, "github.com/pkg/errors", "master", ""))
+	assert.NoError(trashConf.SetVersion(path, "github.com/pkg/errors", "master", "v0.9.2-0.20200101000000-614d223910a1"))
+	assert.NoError(trashConf.SetVersion(path, "github.com/sirupsen/logrus", "839c75faf7f98a33d445d181f3018b5c3409a45e", "v1.5.1-0.20200301000000-839c75faf7f9"))
+	assert.Equal("module foo\n\nrequire (\n\tgithub.com/pkg/errors v0.9.2-0.20200101000000-614d223910a1\n\tgithub.com/sirupsen/logrus v1.4.2\n)\n\nreplace github.com/sirupsen/logrus => github.com/imikushin/logrus v1.5.1-0.20200301000000-839c75faf7f9\n", string(mustRead(t, path)))
+	i, _ := trashConf.Get("github.com/pkg/errors")
+	assert.Equal("master", i.Version)
+
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go tool to check go.mod with")
+	}
+	out, err := exec.Command(goTool, "mod", "edit", "-json", path).CombinedOutput()
+	assert.NoError(err, string(out))
+	var parsed struct {
+		Require []struct{ Path, Version string }
+	}
+	assert.NoError(json.Unmarshal(out, &parsed))
+	assert.Equal("v0.9.2-0.20200101000000-614d223910a1", parsed.Require[0].Version)
+}
+
+func TestAddRemove(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-edit")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	confFile := filepath.Join(dir, "vendor.conf")
+	assert.NoError(ioutil.WriteFile(confFile, []byte("github.com/rancher/trash\ngithub.com/pkg/errors v0.8.1\n-github.com/pkg/errors/internal\npackage=github.com/pkg/errors/cmd\n"), 0644))
+	trashConf, err := Parse(confFile)
+	assert.NoError(err)
+	assert.NoError(trashConf.Add(Import{Package: "github.com/urfave/cli", Version: "v1.22.1", Repo: "https://github.com/imikushin/cli.git", Options: Options{Transitive: true}}))
+	assert.Error(trashConf.Add(Import{Package: "github.com/pkg/errors", Version: "v0.9.1"}))
+	assert.NoError(trashConf.Dump(confFile))
+	assert.Equal("# package\ngithub.com/rancher/trash\n\n# import\ngithub.com/pkg/errors\tv0.8.1\ngithub.com/urfave/cli\tv1.22.1\thttps://github.com/imikushin/cli.git\ttransitive=true\n\n# packages\npackage=github.com/pkg/errors/cmd\n\n# exclude\n-github.com/pkg/errors/internal\n", string(mustRead(t, confFile)))
+
+	parsed, err := Parse(confFile)
+	assert.NoError(err)
+	assert.Equal(trashConf.Imports, parsed.Imports)
+
+	assert.NoError(trashConf.Remove("github.com/pkg/errors"))
+	assert.Error(trashConf.Remove("github.com/pkg/errors"))
+	assert.Empty(trashConf.Excludes)
+	assert.Empty(trashConf.Packages)
+	assert.Equal([]Import{parsed.ImportMap["github.com/urfave/cli"]}, trashConf.Imports)
+
+	modFile := filepath.Join(dir, "go.mod")
+	assert.NoError(ioutil.WriteFile(modFile, []byte("module foo\n\ngo 1.17\n\nrequire github.com/pkg/errors v0.8.1\n"), 0644))
+	trashConf, err = Parse(modFile)
+	assert.NoError(err)
+	assert.NoError(trashConf.Add(Import{Package: "github.com/urfave/cli", Version: "v1.22.1", Repo: "https://github.com/imikushin/cli"}))
+	assert.NoError(trashConf.Remove("github.com/pkg/errors"))
+	assert.NoError(trashConf.Dump(modFile))
+	assert.Equal("module foo\n\ngo 1.17\n\nrequire github.com/urfave/cli v1.22.1\n\nreplace github.com/urfave/cli => github.com/imikushin/cli v1.22.1\n", string(mustRead(t, modFile)))
+}
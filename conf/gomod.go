@@ -0,0 +1,477 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/sirupsen/logrus"
+)
+
+// GoMod holds the directives of a go.mod file that trash cares about.
+type GoMod struct {
+	Module  string
+	Go      string
+	Require []ModuleVersion
+	Replace []Replacement
+	Exclude []ModuleVersion
+
+	// fromSum are the modules which were only in go.sum
+	fromSum map[string]bool
+}
+
+type ModuleVersion struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+type Replacement struct {
+	Old ModuleVersion
+	New ModuleVersion
+}
+
+// ParseGoMod reads the module, go, require, replace and exclude directives
+// of a go.mod file, both in their single line and block forms.
+func ParseGoMod(r io.Reader) (*GoMod, error) {
+	m := &GoMod{}
+	block := ""
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		indirect := false
+		if commentStart := strings.Index(line, "//"); commentStart >= 0 {
+			indirect = strings.TrimSpace(line[commentStart+2:]) == "indirect"
+			line = line[0:commentStart]
+		}
+		fields, err := modFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("go.mod:%d: %v", lineNo, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		verb := block
+		if block == "" {
+			verb, fields = fields[0], fields[1:]
+			if len(fields) == 1 && fields[0] == "(" {
+				block = verb
+				continue
+			}
+		} else if len(fields) == 1 && fields[0] == ")" {
+			block = ""
+			continue
+		}
+
+		switch verb {
+		case "module":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("go.mod:%d: usage: module module/path", lineNo)
+			}
+			m.Module = fields[0]
+		case "go":
+			if len(fields) != 1 {
+				return nil, fmt.Errorf("go.mod:%d: usage: go 1.23", lineNo)
+			}
+			m.Go = fields[0]
+		case "require", "exclude":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("go.mod:%d: usage: %s module/path v1.2.3", lineNo, verb)
+			}
+			mv := ModuleVersion{Path: fields[0], Version: fields[1], Indirect: indirect}
+			if verb == "require" {
+				m.Require = append(m.Require, mv)
+			} else {
+				m.Exclude = append(m.Exclude, mv)
+			}
+		case "replace":
+			arrow := -1
+			for k, f := range fields {
+				if f == "=>" {
+					arrow = k
+				}
+			}
+			if arrow < 1 || arrow > 2 || len(fields)-arrow < 2 || len(fields)-arrow > 3 {
+				return nil, fmt.Errorf("go.mod:%d: usage: replace module/path [v1.2.3] => other/module v1.4 | ../local/dir", lineNo)
+			}
+			rep := Replacement{Old: ModuleVersion{Path: fields[0]}, New: ModuleVersion{Path: fields[arrow+1]}}
+			if arrow == 2 {
+				rep.Old.Version = fields[1]
+			}
+			if len(fields)-arrow == 3 {
+				rep.New.Version = fields[arrow+2]
+			}
+			m.Replace = append(m.Replace, rep)
+		default:
+			// toolchain, retract, godebug and friends don't affect vendoring
+			logrus.Debugf("go.mod:%d: ignoring '%s' directive", lineNo, verb)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if block != "" {
+		return nil, fmt.Errorf("go.mod: unterminated %s block", block)
+	}
+	return m, nil
+}
+
+// modFields splits a go.mod line into fields, unquoting quoted strings.
+func modFields(line string) ([]string, error) {
+	var fields []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		switch line[0] {
+		case '"', '`':
+			end := strings.IndexByte(line[1:], line[0])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			s, err := strconv.Unquote(line[:end+2])
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, s)
+			line = line[end+2:]
+		case '(', ')':
+			fields = append(fields, line[:1])
+			line = line[1:]
+		default:
+			end := strings.IndexAny(line, " \t()")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+		}
+	}
+	return fields, nil
+}
+
+// isLocalPath reports whether a replacement target is a directory rather than a module path.
+func isLocalPath(p string) bool {
+	return p == "." || p == ".." || strings.HasPrefix(p, "./") || strings.HasPrefix(p, "../") || filepath.IsAbs(p)
+}
+
+// VersionRef converts a module version into something git can check out:
+// pseudo-versions become their commit hash, "+incompatible" is dropped from tags.
+func VersionRef(version string) string {
+	version = strings.TrimSuffix(version, "+incompatible")
+	if commit, ok := pseudoVersionCommit(version); ok {
+		return commit
+	}
+	return version
+}
+
+// pseudoVersionCommit extracts the commit prefix from a pseudo-version such
+// as v0.0.0-20190129154638-5b532d6fd5ef or v1.2.4-0.20190129154638-5b532d6fd5ef.
+func pseudoVersionCommit(version string) (string, bool) {
+	parts := strings.Split(version, "-")
+	if len(parts) < 3 || !strings.HasPrefix(version, "v") {
+		return "", false
+	}
+	commit := parts[len(parts)-1]
+	stamp := parts[len(parts)-2]
+	if dot := strings.LastIndex(stamp, "."); dot >= 0 {
+		stamp = stamp[dot+1:]
+	}
+	if len(stamp) != 14 || !isDigits(stamp) || len(commit) != 12 || !isHex(commit) {
+		return "", false
+	}
+	return commit, true
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// modRepo guesses the git URL of a module path.
+func modRepo(modPath string) string {
+	return "https://" + modPath
+}
+
+// Imports converts the requirements into trash imports, applying replace and
+// exclude directives. Local directory replacements are resolved against dir.
+func (m *GoMod) Imports(dir string) []Import {
+	return m.imports(m.Require, dir)
+}
+
+func (m *GoMod) imports(requires []ModuleVersion, dir string) []Import {
+	excluded := map[ModuleVersion]bool{}
+	for _, e := range m.Exclude {
+		excluded[ModuleVersion{Path: e.Path, Version: e.Version}] = true
+	}
+
+	imports := []Import{}
+	for _, r := range requires {
+		if excluded[ModuleVersion{Path: r.Path, Version: r.Version}] {
+			logrus.Warnf("Skipping excluded module '%s@%s'", r.Path, r.Version)
+			continue
+		}
+		i := Import{Package: r.Path, Version: VersionRef(r.Version)}
+		if rep, ok := m.replacement(r); ok {
+			if isLocalPath(rep.New.Path) {
+				repo := rep.New.Path
+				if !filepath.IsAbs(repo) {
+					repo = filepath.Join(dir, repo)
+				}
+				i.Repo = repo
+			} else {
+				i.Repo = modRepo(rep.New.Path)
+				i.Version = VersionRef(rep.New.Version)
+			}
+		}
+		imports = append(imports, i)
+	}
+	return imports
+}
+
+func (m *GoMod) replacement(r ModuleVersion) (Replacement, bool) {
+	var found *Replacement
+	for k, rep := range m.Replace {
+		if rep.Old.Path != r.Path {
+			continue
+		}
+		if rep.Old.Version == r.Version {
+			return rep, true // a version specific replacement wins
+		}
+		if rep.Old.Version == "" {
+			found = &m.Replace[k]
+		}
+	}
+	if found == nil {
+		return Replacement{}, false
+	}
+	return *found, true
+}
+
+// goSumVersions returns the highest version of every module with source
+// (not just go.mod) checksums in a go.sum file.
+func goSumVersions(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	versions := map[string]*semver.Version{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		v, err := semver.NewVersion(fields[1])
+		if err != nil {
+			continue
+		}
+		if cur, ok := versions[fields[0]]; !ok || cur.LessThan(v) {
+			versions[fields[0]] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	r := make(map[string]string, len(versions))
+	for p, v := range versions {
+		r[p] = v.Original()
+	}
+	return r, nil
+}
+
+// needsGoSum reports whether the go.mod predates module graph pruning
+// (go 1.17), in which case it only lists direct dependencies.
+func (m *GoMod) needsGoSum() bool {
+	if m.Go == "" {
+		return true
+	}
+	v, err := semver.NewVersion(m.Go)
+	if err != nil {
+		return false
+	}
+	return v.LessThan(semver.MustParse("1.17"))
+}
+
+func parseGoMod(path string) (*Conf, error) {
+	dir := filepath.Dir(path)
+	file, err := os.Open(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m, err := ParseGoMod(file)
+	if err != nil {
+		return nil, err
+	}
+
+	requires := m.Require
+	if m.needsGoSum() {
+		versions, err := goSumVersions(filepath.Join(dir, "go.sum"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		required := map[string]bool{}
+		for _, r := range m.Require {
+			required[r.Path] = true
+		}
+		m.fromSum = map[string]bool{}
+		for p, v := range versions {
+			if !required[p] {
+				logrus.Debugf("Adding indirect module '%s@%s' from go.sum", p, v)
+				requires = append(requires, ModuleVersion{Path: p, Version: v, Indirect: true})
+				m.fromSum[p] = true
+			}
+		}
+	}
+
+	trashConf := &Conf{confFile: path, goMod: m}
+	trashConf.Package = m.Module
+	trashConf.Imports = m.imports(requires, dir)
+	trashConf.Dedupe()
+	return trashConf, nil
+}
+
+// Write formats the go.mod file the way `go mod tidy` would.
+func (m *GoMod) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "module %s\n", modQuote(m.Module))
+	if m.Go != "" {
+		fmt.Fprintf(bw, "\ngo %s\n", m.Go)
+	}
+
+	var direct, indirect []string
+	for _, r := range m.Require {
+		line := modQuote(r.Path) + " " + r.Version
+		if r.Indirect {
+			indirect = append(indirect, line+" // indirect")
+		} else {
+			direct = append(direct, line)
+		}
+	}
+	writeModBlock(bw, "require", direct)
+	writeModBlock(bw, "require", indirect)
+
+	var replace []string
+	for _, r := range m.Replace {
+		line := strings.TrimSpace(modQuote(r.Old.Path) + " " + r.Old.Version)
+		line += " => " + strings.TrimSpace(modQuote(r.New.Path)+" "+r.New.Version)
+		replace = append(replace, line)
+	}
+	writeModBlock(bw, "replace", replace)
+
+	var exclude []string
+	for _, e := range m.Exclude {
+		exclude = append(exclude, modQuote(e.Path)+" "+e.Version)
+	}
+	writeModBlock(bw, "exclude", exclude)
+
+	return bw.Flush()
+}
+
+func writeModBlock(w io.Writer, verb string, lines []string) {
+	switch len(lines) {
+	case 0:
+	case 1:
+		fmt.Fprintf(w, "\n%s %s\n", verb, lines[0])
+	default:
+		fmt.Fprintf(w, "\n%s (\n", verb)
+		for _, l := range lines {
+			fmt.Fprintf(w, "\t%s\n", l)
+		}
+		fmt.Fprintln(w, ")")
+	}
+}
+
+func modQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"'`()") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// modVersion returns the module version of i: its ModVersion, or else its
+// version if it's a canonical semantic version, or "" if it has none.
+func modVersion(i Import) string {
+	if i.ModVersion != "" {
+		return i.ModVersion
+	}
+	if v, err := semver.NewVersion(i.Version); err == nil && "v"+v.String() == i.Version {
+		return i.Version
+	}
+	return ""
+}
+
+// modFile rebuilds the go.mod the conf was parsed from with its current
+// imports. The modules which were only in go.sum stay out of it.
+func (t *Conf) modFile() *GoMod {
+	m := &GoMod{Module: t.Package, Go: t.goMod.Go, Exclude: t.goMod.Exclude}
+	required := map[string]ModuleVersion{}
+	for _, r := range t.goMod.Require {
+		required[r.Path] = r
+	}
+	replaced := map[string]Replacement{}
+	for _, r := range t.goMod.Replace {
+		replaced[r.Old.Path] = r
+	}
+
+	for _, i := range t.Imports {
+		r, ok := required[i.Package]
+		if !ok && t.goMod.fromSum[i.Package] {
+			continue
+		}
+		if !ok {
+			r = ModuleVersion{Path: i.Package, Indirect: true}
+		}
+		rep, isReplaced := replaced[i.Package]
+		switch {
+		case isReplaced && !isLocalPath(rep.New.Path):
+			if VersionRef(rep.New.Version) != i.Version {
+				rep.New.Version = t.newModVersion(i, rep.New.Version)
+			}
+		case VersionRef(r.Version) != i.Version:
+			r.Version = t.newModVersion(i, r.Version)
+		}
+		if r.Version == "" {
+			logrus.Warnf("No module version for '%s' (in %s)", i.Package, t.confFile)
+			continue
+		}
+		m.Require = append(m.Require, r)
+		if isReplaced {
+			m.Replace = append(m.Replace, rep)
+		}
+	}
+	return m
+}
+
+// newModVersion returns the module version i changed to, or old if it has
+// none: go.mod only takes module versions, not branches or commits.
+func (t *Conf) newModVersion(i Import, old string) string {
+	if v := modVersion(i); v != "" || old == "" {
+		return v
+	}
+	logrus.Warnf("No module version for '%s' at '%s': leaving it at '%s' (in %s)", i.Package, i.Version, old, t.confFile)
+	return old
+}
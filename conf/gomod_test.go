@@ -0,0 +1,144 @@
+package conf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testGoMod = `module github.com/rancher/trash
+
+go 1.12
+
+require (
+	github.com/Masterminds/semver v1.4.2
+	github.com/pkg/errors v0.8.1 // indirect
+	golang.org/x/sys v0.0.0-20190710143415-6ec70d6a5542
+	github.com/docker/docker v17.12.0-ce-rc1.0.20180916195708-5b532d6fd5ef+incompatible
+)
+
+require github.com/sirupsen/logrus v1.4.2
+
+replace github.com/sirupsen/logrus => github.com/imikushin/logrus v1.4.3
+
+replace (
+	github.com/pkg/errors v0.8.1 => ../errors
+)
+
+exclude golang.org/x/sys v0.0.0-20190710143415-6ec70d6a5542
+`
+
+func TestParseGoMod(t *testing.T) {
+	assert := require.New(t)
+
+	m, err := ParseGoMod(strings.NewReader(testGoMod))
+	assert.NoError(err)
+	assert.Equal("github.com/rancher/trash", m.Module)
+	assert.Equal("1.12", m.Go)
+	assert.Len(m.Require, 5)
+	assert.True(m.Require[1].Indirect)
+	assert.Len(m.Replace, 2)
+	assert.Equal("v0.8.1", m.Replace[1].Old.Version)
+	assert.Equal("../errors", m.Replace[1].New.Path)
+	assert.Len(m.Exclude, 1)
+
+	imports := m.Imports("/src/trash")
+	assert.Len(imports, 4)
+	assert.Equal(Import{Package: "github.com/Masterminds/semver", Version: "v1.4.2"}, imports[0])
+	assert.Equal(Import{Package: "github.com/pkg/errors", Version: "v0.8.1", Repo: "/src/errors"}, imports[1])
+	assert.Equal(Import{Package: "github.com/docker/docker", Version: "5b532d6fd5ef"}, imports[2])
+	assert.Equal(Import{Package: "github.com/sirupsen/logrus", Version: "v1.4.3", Repo: "https://github.com/imikushin/logrus"}, imports[3])
+}
+
+func TestParseGoModErrors(t *testing.T) {
+	for _, s := range []string{
+		"module",
+		"require github.com/pkg/errors",
+		"require (\ngithub.com/pkg/errors v0.8.1\n",
+		"replace github.com/pkg/errors v0.8.1",
+		`module "github.com/rancher/trash`,
+	} {
+		_, err := ParseGoMod(strings.NewReader(s))
+		require.Error(t, err, s)
+	}
+}
+
+func TestVersionRef(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal("v1.4.2", VersionRef("v1.4.2"))
+	assert.Equal("v2.0.0", VersionRef("v2.0.0+incompatible"))
+	assert.Equal("6ec70d6a5542", VersionRef("v0.0.0-20190710143415-6ec70d6a5542"))
+	assert.Equal("6ec70d6a5542", VersionRef("v1.2.4-0.20190710143415-6ec70d6a5542"))
+	assert.Equal("v1.0.0-rc1", VersionRef("v1.0.0-rc1"))
+}
+
+func TestGoModRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-gomod")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	modFile := filepath.Join(dir, "go.mod")
+	assert.NoError(ioutil.WriteFile(modFile, []byte(testGoMod), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "go.sum"), []byte(`github.com/mitchellh/go-homedir v1.0.0 h1:aaa=
+github.com/mitchellh/go-homedir v1.1.0 h1:bbb=
+github.com/mitchellh/go-homedir v1.2.0/go.mod h1:ccc=
+`), 0644))
+
+	trashConf, err := Parse(modFile)
+	assert.NoError(err)
+	assert.Equal("github.com/rancher/trash", trashConf.Package)
+	i, ok := trashConf.Get("github.com/mitchellh/go-homedir")
+	assert.True(ok)
+	assert.Equal("v1.1.0", i.Version)
+
+	assert.NoError(trashConf.Dump(modFile))
+	m, err := ParseGoMod(bytes.NewReader(mustRead(t, modFile)))
+	assert.NoError(err)
+	assert.Equal("github.com/rancher/trash", m.Module)
+	assert.Equal("1.12", m.Go)
+	assert.Len(m.Require, 4, "the modules only in go.sum stay out")
+	assert.Len(m.Replace, 2)
+	assert.Len(m.Exclude, 1)
+
+	// branches and commits go in as their module versions
+	assert.True(trashConf.IsGoMod())
+	for k, i := range trashConf.Imports {
+		switch i.Package {
+		case "github.com/Masterminds/semver":
+			trashConf.Imports[k].Version = "master"
+			trashConf.Imports[k].ModVersion = "v1.4.3-0.20190812120000-0123456789ab"
+		case "github.com/docker/docker":
+			trashConf.Imports[k].Version = "0123456789abcdef0123456789abcdef01234567"
+		case "github.com/sirupsen/logrus":
+			trashConf.Imports[k].Version = "v1.5.0"
+		}
+	}
+	assert.NoError(trashConf.Dump(modFile))
+	m, err = ParseGoMod(bytes.NewReader(mustRead(t, modFile)))
+	assert.NoError(err)
+	versions := map[string]string{}
+	for _, r := range m.Require {
+		versions[r.Path] = r.Version
+	}
+	assert.Equal("v1.4.3-0.20190812120000-0123456789ab", versions["github.com/Masterminds/semver"])
+	assert.Equal("v17.12.0-ce-rc1.0.20180916195708-5b532d6fd5ef+incompatible", versions["github.com/docker/docker"], "left alone without a module version")
+	assert.Equal("v1.4.2", versions["github.com/sirupsen/logrus"])
+	for _, r := range m.Replace {
+		if r.Old.Path == "github.com/sirupsen/logrus" {
+			assert.Equal("v1.5.0", r.New.Version)
+		}
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
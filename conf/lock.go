@@ -0,0 +1,90 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Lock is what trash.lock records: the exact state every import got vendored at.
+type Lock struct {
+	Package  string         `yaml:"package,omitempty"`
+	Imports  []LockedImport `yaml:"import,omitempty"`
+	Excludes []string       `yaml:"exclude,omitempty"`
+}
+
+type LockedImport struct {
+	Package string `yaml:"package"`
+	Version string `yaml:"version"`
+	Repo    string `yaml:"repo,omitempty"`
+	// Tag is what a version constraint resolved to
+	Tag    string `yaml:"tag,omitempty"`
+	Commit string `yaml:"commit,omitempty"`
+	Remote string `yaml:"remote,omitempty"`
+	Hash   string `yaml:"hash,omitempty"`
+}
+
+type LockedImports []LockedImport
+
+func (i LockedImports) Len() int {
+	return len(i)
+}
+
+func (i LockedImports) Less(k, j int) bool {
+	return i[k].Package < i[j].Package
+}
+
+func (i LockedImports) Swap(k, j int) {
+	i[k], i[j] = i[j], i[k]
+}
+
+// ParseLock reads a trash.lock. Locks written by older trash versions parse
+// fine, they just have no commits or hashes.
+func ParseLock(path string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lock := &Lock{}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (l *Lock) Get(pkg string) (LockedImport, bool) {
+	for _, i := range l.Imports {
+		if i.Package == pkg {
+			return i, true
+		}
+	}
+	return LockedImport{}, false
+}
+
+// Pin makes the imports of c check out the commits recorded in the lock,
+// unless their version or repo changed since the lock was written.
+func (l *Lock) Pin(c *Conf) {
+	for k, i := range c.Imports {
+		locked, ok := l.Get(i.Package)
+		if !ok || locked.Commit == "" || locked.Version != i.Version || locked.Repo != i.Repo {
+			continue
+		}
+		logrus.Debugf("Pinning '%s' at '%s' to commit '%s'", i.Package, i.Version, locked.Commit)
+		c.Imports[k].Commit = locked.Commit
+		c.Imports[k].Tag = locked.Tag
+	}
+	c.Dedupe()
+}
+
+func (l *Lock) Dump(path string) error {
+	sort.Sort(LockedImports(l.Imports))
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(path)
+	return ioutil.WriteFile(path, data, 0644)
+}
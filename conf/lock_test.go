@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-lock")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	lockFile := filepath.Join(dir, "trash.lock")
+
+	// locks written by older versions are plain confs
+	assert.NoError(ioutil.WriteFile(lockFile, []byte(`package: github.com/rancher/trash
+import:
+- package: github.com/pkg/errors
+  version: v0.8.1
+`), 0644))
+	lock, err := ParseLock(lockFile)
+	assert.NoError(err)
+	i, ok := lock.Get("github.com/pkg/errors")
+	assert.True(ok)
+	assert.Equal("", i.Commit)
+
+	lock.Imports = []LockedImport{
+		{Package: "golang.org/x/sys", Version: "master", Commit: "fde4db37ae7ad8191b03d30d27f258b5291ae4e3", Hash: "h1:x"},
+		{Package: "github.com/pkg/errors", Version: "v0.8.1", Commit: "ba968bfe8b2f7e042a574c888954fccecfa385b4"},
+		{Package: "github.com/sirupsen/logrus", Version: "v1.4.2", Commit: "839c75faf7f98a33d445d181f3018b5c3409a45e"},
+	}
+	assert.NoError(lock.Dump(lockFile))
+	lock, err = ParseLock(lockFile)
+	assert.NoError(err)
+	assert.Equal("github.com/pkg/errors", lock.Imports[0].Package)
+	assert.Equal("h1:x", lock.Imports[2].Hash)
+
+	trashConf := &Conf{Imports: []Import{
+		{Package: "golang.org/x/sys", Version: "master"},
+		{Package: "github.com/pkg/errors", Version: "v0.9.0"},
+		{Package: "github.com/sirupsen/logrus", Version: "v1.4.2", Repo: "https://github.com/imikushin/logrus.git"},
+		{Package: "github.com/urfave/cli", Version: "v1.21.0"},
+	}}
+	lock.Pin(trashConf)
+	for pkg, commit := range map[string]string{
+		"golang.org/x/sys":           "fde4db37ae7ad8191b03d30d27f258b5291ae4e3",
+		"github.com/pkg/errors":      "",
+		"github.com/sirupsen/logrus": "",
+		"github.com/urfave/cli":      "",
+	} {
+		i, ok := trashConf.Get(pkg)
+		assert.True(ok)
+		assert.Equal(commit, i.Commit, pkg)
+	}
+}
@@ -0,0 +1,182 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// parseTOML understands the subset of TOML used by dep's Gopkg.toml and
+// Gopkg.lock: tables, arrays of tables, and string, bool, integer and array
+// values. Arrays of tables are returned as []map[string]interface{}.
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	current := root
+
+	p := &tomlParser{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p.lineNo++
+		line := p.pending + scanner.Text()
+		p.pending = ""
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[["):
+			if !strings.HasSuffix(line, "]]") {
+				return nil, p.errorf("malformed array of tables: %s", line)
+			}
+			name := strings.TrimSpace(line[2 : len(line)-2])
+			tables, _ := root[name].([]map[string]interface{})
+			if _, ok := root[name]; ok && tables == nil {
+				return nil, p.errorf("'%s' is not an array of tables", name)
+			}
+			current = map[string]interface{}{}
+			root[name] = append(tables, current)
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, p.errorf("malformed table: %s", line)
+			}
+			current = map[string]interface{}{}
+			root[strings.TrimSpace(line[1:len(line)-1])] = current
+		default:
+			eq := strings.Index(line, "=")
+			if eq < 0 {
+				return nil, p.errorf("expected key = value: %s", line)
+			}
+			key := strings.Trim(strings.TrimSpace(line[:eq]), `"`)
+			raw := strings.TrimSpace(line[eq+1:])
+			if strings.HasPrefix(raw, "[") && strings.Count(raw, "[") > strings.Count(raw, "]") {
+				// multi-line array: keep reading
+				p.pending = line + " "
+				continue
+			}
+			v, rest, err := p.value(raw)
+			if err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(rest) != "" {
+				return nil, p.errorf("unexpected '%s' after value", rest)
+			}
+			current[key] = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.pending != "" {
+		return nil, p.errorf("unterminated array")
+	}
+	return root, nil
+}
+
+type tomlParser struct {
+	lineNo  int
+	pending string
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("toml:%d: %s", p.lineNo, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) value(s string) (interface{}, string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for k := 1; k < len(s); k++ {
+			if s[k] == '\\' {
+				k++
+				continue
+			}
+			if s[k] == '"' {
+				v, err := strconv.Unquote(s[:k+1])
+				if err != nil {
+					return nil, "", p.errorf("bad string %s: %v", s[:k+1], err)
+				}
+				return v, s[k+1:], nil
+			}
+		}
+		return nil, "", p.errorf("unterminated string: %s", s)
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return nil, "", p.errorf("unterminated string: %s", s)
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case strings.HasPrefix(s, "["):
+		var values []interface{}
+		s = strings.TrimSpace(s[1:])
+		for !strings.HasPrefix(s, "]") {
+			v, rest, err := p.value(s)
+			if err != nil {
+				return nil, "", err
+			}
+			values = append(values, v)
+			s = strings.TrimSpace(rest)
+			if strings.HasPrefix(s, ",") {
+				s = strings.TrimSpace(s[1:])
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", p.errorf("expected ',' or ']' in array")
+			}
+		}
+		return values, s[1:], nil
+	case strings.HasPrefix(s, "true"):
+		return true, s[4:], nil
+	case strings.HasPrefix(s, "false"):
+		return false, s[5:], nil
+	default:
+		end := strings.IndexAny(s, " \t,]")
+		if end < 0 {
+			end = len(s)
+		}
+		n, err := strconv.ParseInt(s[:end], 10, 64)
+		if err != nil {
+			return nil, "", p.errorf("unsupported value: %s", s)
+		}
+		return n, s[end:], nil
+	}
+}
+
+// stripTOMLComment drops a trailing # comment, leaving # inside strings alone.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for k := 0; k < len(line); k++ {
+		c := line[k]
+		switch {
+		case quote != 0 && c == '\\' && quote == '"':
+			k++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:k]
+		}
+	}
+	return line
+}
+
+func tomlString(t map[string]interface{}, key string) string {
+	s, _ := t[key].(string)
+	return s
+}
+
+func tomlStrings(t map[string]interface{}, key string) []string {
+	var r []string
+	vs, _ := t[key].([]interface{})
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+func tomlTables(t map[string]interface{}, key string) []map[string]interface{} {
+	tables, _ := t[key].([]map[string]interface{})
+	return tables
+}
@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Add adds i to the conf file and vendors just that package (and its
+// dependencies, if it's transitive), at its latest tag unless i has a version.
+func Add(opts Options, i conf.Import) error {
+	p, err := loadProject(opts, false)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	trashConf := p.trashConf
+	if _, ok := trashConf.Get(i.Package); ok {
+		return &ConfError{ConfFile: trashConf.ConfFile(), Package: i.Package, Reason: "is already there, update it to change its version"}
+	}
+
+	if err := p.cache.prepare(i); err != nil {
+		return err
+	}
+	if i.Version == "" {
+		if i.Version, err = p.cache.latestVersion(i); err != nil {
+			return err
+		}
+	}
+	if trashConf.IsGoMod() {
+		if i.ModVersion, err = p.modVersion(i); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Adding '%s' at '%s'", i.Package, i.Version)
+	if err := trashConf.Add(i); err != nil {
+		return err
+	}
+
+	return p.stage(func() error {
+		if err := p.dumpConf(trashConf); err != nil {
+			return err
+		}
+		added := map[string]bool{}
+		revisions := map[string]revision{}
+		for queue := []conf.Import{i}; len(queue) > 0; queue = queue[1:] {
+			i := queue[0]
+			if revisions[i.Package], err = p.vendorImport(i); err != nil {
+				return err
+			}
+			added[i.Package] = true
+			if !i.Transitive {
+				continue
+			}
+			imports, _, err := transitiveImports(p.cache.repoDir(i.Package))
+			if err != nil {
+				return err
+			}
+			for _, t := range imports {
+				if _, ok := trashConf.Get(t.Package); ok {
+					continue
+				}
+				if t.Version == "" {
+					logrus.Warnf("No version for '%s' (a dependency of '%s'): skipping it", t.Package, i.Package)
+					continue
+				}
+				logrus.Infof("Adding '%s' at '%s' (a dependency of '%s')", t.Package, t.Version, i.Package)
+				// only vendored and locked: the conf file gets just the package asked for
+				trashConf.Imports = append(trashConf.Imports, t)
+				trashConf.Dedupe()
+				if err := p.cache.prepare(t); err != nil {
+					return err
+				}
+				queue = append(queue, t)
+			}
+		}
+
+		return p.relock(added, revisions)
+	})
+}
@@ -0,0 +1,479 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/util"
+
+	"github.com/Masterminds/semver"
+	"github.com/Masterminds/vcs"
+	"github.com/sirupsen/logrus"
+)
+
+// cache is the GOPATH-like dir where the repos of the imports are cloned,
+// shared by all the runs of trash. Git repos are kept once per URL under
+// repos/, with a worktree under src/ mapping the import onto them; other
+// repos are cloned under src/. A commit is exported once to a tree of its
+// own under trees/, which is never changed afterwards: runs copy from there,
+// so that the repos are only changed to fetch, under a lock.
+type cache struct {
+	dir      string
+	work     string
+	insecure bool
+	offline  bool
+	mirrors  *mirrorRules
+	proxy    string
+	events   Listener
+	cancel   <-chan struct{}
+
+	mutex      sync.Mutex
+	checkedOut map[string]checkout
+}
+
+// defaultBranch is the version which stands for the default branch of a
+// repo, whatever it's called, as the HEAD of the remote says.
+const defaultBranch = "HEAD"
+
+// checkout is what's been checked out for an import in this run, and the
+// tree it's in.
+type checkout struct {
+	version string
+	rev     revision
+	tree    string
+}
+
+// repoDir is where pkg is checked out in this run: in the tree of the import
+// it's in, the closest one up from it.
+func (c *cache) repoDir(pkg string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for p := pkg; p != "." && p != "/"; p = path.Dir(p) {
+		if done, ok := c.checkedOut[p]; ok {
+			return filepath.Join(done.tree, filepath.FromSlash(strings.TrimPrefix(pkg, p)))
+		}
+	}
+	return path.Join(c.work, "src", pkg)
+}
+
+// cloneDir is where the repo of pkg is kept.
+func (c *cache) cloneDir(pkg string) string {
+	return path.Join(c.dir, "src", pkg)
+}
+
+func (c *cache) storeRoot() string {
+	return filepath.Join(c.dir, "repos")
+}
+
+// storeDir returns where the repo fetched from url is kept.
+func (c *cache) storeDir(url string) string {
+	return filepath.Join(c.storeRoot(), filepath.FromSlash(storeKey(url)))
+}
+
+func (c *cache) treeRoot() string {
+	return filepath.Join(c.dir, "trees")
+}
+
+// treeKey returns the path of the tree of commit. Commits which are hashes
+// are the same whichever repo they're in, so they're all it takes; others
+// (like svn revisions) are kept under the repo fetched from url.
+func treeKey(url, commit string) string {
+	if len(commit) == 40 && strings.Trim(strings.ToLower(commit), "0123456789abcdef") == "" {
+		return strings.ToLower(commit)
+	}
+	return path.Join(storeKey(url), commit)
+}
+
+// lock locks dir against the other jobs and the other runs of trash,
+// returning the func to unlock it.
+func (c *cache) lock(dir string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, err
+	}
+	return util.LockFile(dir + ".lock")
+}
+
+// close removes what the run checked out.
+func (c *cache) close() error {
+	return os.RemoveAll(c.work)
+}
+
+// storeKey turns a repo URL into a path which is the same however the URL
+// is spelled: scheme, user, port, case of the host and ".git" don't count.
+// Local repos are kept under "file".
+func storeKey(url string) string {
+	p := replacementPath(strings.TrimPrefix(url, "file://"))
+	if filepath.IsAbs(p) || strings.HasPrefix(p, ".") {
+		abs, _ := filepath.Abs(p)
+		return path.Join("file", strings.TrimSuffix(filepath.ToSlash(abs), ".git"))
+	}
+	host, rest := p, ""
+	if k := strings.Index(p, "/"); k >= 0 {
+		host, rest = p[:k], p[k:]
+	}
+	if k := strings.Index(host, ":"); k >= 0 {
+		host = host[:k]
+	}
+	return path.Clean(strings.ToLower(host) + rest)
+}
+
+// resolve turns an import of a package inside a repo in the cache into an
+// import of the whole repo, from where that repo came from. Imports with a
+// repo URL are left alone.
+func (c *cache) resolve(i conf.Import) conf.Import {
+	if i.Repo != "" {
+		return i
+	}
+	pkg, err := c.topLevel(i.Package)
+	if err != nil || pkg == i.Package {
+		return i
+	}
+	i.Package = pkg
+	dir := c.cloneDir(pkg)
+	if isProxyDir(dir) {
+		return i // modules come from the proxy of the run
+	}
+	if newRepo, ok := backends[detectVCS(dir, "")]; ok {
+		i.Repo, _ = newRepo(c, dir, i).remoteURL()
+	}
+	return i
+}
+
+// repo returns the repo of i in the cache, of the kind its vcs option names
+// or else the kind detected from its dir and URL. Imports without either
+// come from the proxy, if there's one.
+func (c *cache) repo(i conf.Import) (repo, error) {
+	i = c.resolve(i)
+	dir := c.cloneDir(i.Package)
+	kind := i.VCS
+	if kind == "" && i.Repo == "" && c.proxy != "" {
+		kind = "proxy"
+	} else if kind == "" {
+		kind = detectVCS(dir, i.Repo)
+	}
+	newRepo, ok := backends[kind]
+	if !ok {
+		return nil, &PackageError{Package: i.Package, Err: fmt.Errorf("unknown vcs '%s'", kind)}
+	}
+	return newRepo(c, dir, i), nil
+}
+
+// prepare makes sure the repo of i is in the cache, with the remote to get it from.
+func (c *cache) prepare(i conf.Import) error {
+	logrus.WithFields(logrus.Fields{"trashDir": c.dir, "i": i}).Debug("entering prepareCache")
+	r, err := c.repo(i)
+	if err != nil {
+		return err
+	}
+	if err := r.prepare(); err != nil {
+		return &PackageError{Package: i.Package, Err: err}
+	}
+	return nil
+}
+
+// checkout checks out i to the tree of its commit, leaving its repo as it is.
+func (c *cache) checkout(i conf.Import) error {
+	if err := c.doCheckout(c.resolve(i)); err != nil {
+		return &PackageError{Package: i.Package, Err: err}
+	}
+	return nil
+}
+
+func (c *cache) doCheckout(i conf.Import) error {
+	logrus.WithFields(logrus.Fields{"trashDir": c.dir, "i": i}).Debug("entering checkout")
+	r, err := c.repo(i)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Checking out '%s', commit: '%s'", i.Package, i.Version)
+	version := i.Version
+	if i.Tag != "" {
+		version = i.Tag
+	}
+	if i.Commit != "" {
+		logrus.Infof("Using commit '%s' from the lock", i.Commit)
+		version = i.Commit
+	}
+	c.mutex.Lock()
+	done, ok := c.checkedOut[i.Package]
+	c.mutex.Unlock()
+	if ok && done.version == version {
+		logrus.Debugf("'%s' is already checked out at '%s'", i.Package, version)
+		return nil
+	}
+	ref := version
+	fetched := false
+	if i.Commit == "" {
+		b, ok := r.branch(version)
+		if !ok && version != defaultBranch && !c.offline {
+			if _, err := r.revision(version); err != nil {
+				// it may be a branch made since the repo was last fetched
+				if err := c.fetch(r, i); err != nil {
+					return err
+				}
+				fetched = true
+				b, ok = r.branch(version)
+			}
+		}
+		if ok || version == defaultBranch {
+			ref = b
+			if !fetched {
+				if err := c.fetch(r, i); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	c.events.OnEvent(Event{Kind: EventCheckout, Package: i.Package, Version: ref})
+	rev, err := r.revision(ref)
+	if err != nil {
+		logrus.Debugf("No commit for '%s': %v", ref, err)
+		if i.Version == defaultBranch && i.Commit == "" {
+			logrus.Warnf("Failed to checkout the default branch of '%s': checking out the latest commit we can find", i.Package)
+			if ref, err = r.latest(); err != nil {
+				return err
+			}
+		} else if c.offline {
+			return notCachedError(fmt.Sprintf("'%s'", ref))
+		} else if fetched {
+			return err
+		} else if err := c.fetch(r, i); err != nil {
+			return err
+		}
+		logrus.Debugf("Retrying!: checking out '%s'", ref)
+		if rev, err = r.revision(ref); err != nil {
+			return err
+		}
+	}
+	tree, err := c.tree(r, rev.Commit)
+	if err != nil {
+		return err
+	}
+	if major := moduleMajor(i.Package); major != "" && strings.HasSuffix(i.Package, "/"+major) {
+		if _, err := os.Stat(filepath.Join(tree, major, "go.mod")); err == nil {
+			tree = filepath.Join(tree, major) // the module is in a dir of its own in the repo
+		}
+	}
+	c.mutex.Lock()
+	if c.checkedOut == nil {
+		c.checkedOut = map[string]checkout{}
+	}
+	c.checkedOut[i.Package] = checkout{version: version, rev: rev, tree: tree}
+	c.mutex.Unlock()
+	return nil
+}
+
+// tree returns the tree of commit, exporting it from r unless it's been
+// already. Trees are exported next to where they go and renamed into place,
+// so that one that's there is complete.
+func (c *cache) tree(r repo, commit string) (string, error) {
+	url, err := r.remoteURL()
+	if err != nil {
+		return "", err
+	}
+	tree := filepath.Join(c.treeRoot(), filepath.FromSlash(treeKey(url, commit)))
+	if _, err := os.Stat(tree); err == nil {
+		logrus.Debugf("Using the tree of '%s' in '%s'", commit, tree)
+		return tree, nil
+	}
+	unlock, err := c.lock(tree)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := os.Stat(tree); err == nil {
+		return tree, nil
+	}
+	tmp := tree + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := r.export(commit, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, tree); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tree, nil
+}
+
+func (c *cache) fetch(r repo, i conf.Import) error {
+	if c.offline {
+		logrus.Debugf("Offline: not fetching '%s'", i.Package)
+		return nil
+	}
+	logrus.Infof("Fetching latest commits for '%s'", i.Package)
+	c.events.OnEvent(Event{Kind: EventFetch, Package: i.Package})
+	return r.fetch()
+}
+
+// topLevel returns the package of the whole repo pkg is in: the closest
+// dir up from it with a repo in it.
+func (c *cache) topLevel(pkg string) (string, error) {
+	for p := pkg; p != "." && p != "/"; p = path.Dir(p) {
+		if _, err := vcs.DetectVcsFromFS(c.cloneDir(p)); err == nil || isProxyDir(c.cloneDir(p)) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not in a repo in the cache", pkg)
+}
+
+// revision returns the commit of ref in the repo of i, and when it was made.
+// HEAD is what's been checked out for i in this run, or else the latest
+// commit its repo has.
+func (c *cache) revision(i conf.Import, ref string) (revision, error) {
+	i = c.resolve(i)
+	if ref == "HEAD" {
+		c.mutex.Lock()
+		done, ok := c.checkedOut[i.Package]
+		c.mutex.Unlock()
+		if ok {
+			return done.rev, nil
+		}
+	}
+	r, err := c.repo(i)
+	if err != nil {
+		return revision{}, err
+	}
+	if ref == "HEAD" {
+		if ref, err = r.latest(); err != nil {
+			return revision{}, err
+		}
+	}
+	return r.revision(ref)
+}
+
+// remote returns where the repo of i is fetched from.
+func (c *cache) remote(i conf.Import) (string, error) {
+	if i.Repo != "" {
+		return i.Repo, nil
+	}
+	r, err := c.repo(i)
+	if err != nil {
+		return "", err
+	}
+	return r.remoteURL()
+}
+
+// branch returns the ref of the branch of i called name, and whether there's one.
+func (c *cache) branch(i conf.Import, name string) (string, bool) {
+	r, err := c.repo(i)
+	if err != nil {
+		return name, false
+	}
+	return r.branch(name)
+}
+
+// behind counts the commits of the repo of i from commit to ref.
+func (c *cache) behind(i conf.Import, commit, ref string) (int, error) {
+	r, err := c.repo(i)
+	if err != nil {
+		return 0, err
+	}
+	return r.behind(commit, ref)
+}
+
+// latestVersion returns the latest tag of i in the major version its import
+// path is pinned to, if any, or else the branch of that major version, or
+// else the latest commit.
+func (c *cache) latestVersion(i conf.Import) (string, error) {
+	sortedTags, err := c.majorTags(i)
+	if err != nil {
+		return "", err
+	}
+	if major := moduleMajor(i.Package); len(sortedTags) == 0 && major != "" {
+		if _, ok := c.branch(i, major); ok {
+			return major, nil
+		}
+	}
+	if len(sortedTags) == 0 {
+		rev, err := c.revision(i, "HEAD")
+		return rev.Commit, err
+	}
+	latestTag := sortedTags[len(sortedTags)-1].Original()
+
+	return strings.TrimSpace(latestTag), nil
+}
+
+// resolveTag returns the highest tag matching the version constraint of i, in
+// the major version its import path is pinned to, or "" when its version
+// isn't a constraint.
+func (c *cache) resolveTag(i conf.Import) (string, error) {
+	constraint, ok := conf.ParseConstraint(i.Version)
+	if !ok {
+		return "", nil
+	}
+	sortedTags, err := c.majorTags(i)
+	if err != nil {
+		return "", err
+	}
+	for k := len(sortedTags) - 1; k >= 0; k-- {
+		if constraint.Check(sortedTags[k]) {
+			tag := sortedTags[k].Original()
+			logrus.Infof("Resolved '%s' %s to '%s'", i.Package, i.Version, tag)
+			c.events.OnEvent(Event{Kind: EventResolve, Package: i.Package, Version: tag})
+			return tag, nil
+		}
+	}
+	return "", &PackageError{Package: i.Package, Err: fmt.Errorf("no tag matches '%s'", i.Version)}
+}
+
+// majorTags returns the semverTags of i of the major version its import path
+// is pinned to, like v3 for github.com/foo/bar/v3 or v2 for gopkg.in/yaml.v2,
+// or all of them when it isn't.
+func (c *cache) majorTags(i conf.Import) ([]*semver.Version, error) {
+	tags, err := c.semverTags(i)
+	major := moduleMajor(i.Package)
+	if err != nil || major == "" {
+		return tags, err
+	}
+	inMajor := make([]*semver.Version, 0, len(tags))
+	for _, v := range tags {
+		if fmt.Sprintf("v%d", v.Major()) == major {
+			inMajor = append(inMajor, v)
+		}
+	}
+	return inMajor, nil
+}
+
+// semverTags fetches the tags of i into its repo in the cache, unless
+// offline, and returns those which are semantic versions, sorted.
+func (c *cache) semverTags(i conf.Import) ([]*semver.Version, error) {
+	r, err := c.repo(i)
+	if err != nil {
+		return nil, err
+	}
+	if c.offline {
+		logrus.Debugf("Offline: using the tags of '%s' in the cache", i.Package)
+	} else if err := r.fetch(); err != nil {
+		return nil, &PackageError{Package: i.Package, Err: err}
+	}
+
+	tags, err := r.tags()
+	if err != nil {
+		return nil, err
+	}
+
+	sortedTags := make([]*semver.Version, 0)
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err == semver.ErrInvalidSemVer {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sortedTags = append(sortedTags, v)
+	}
+
+	sort.Sort(semver.Collection(sortedTags))
+	return sortedTags, nil
+}
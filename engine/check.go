@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rdeusser/trash/util"
+
+	"github.com/pkg/errors"
+)
+
+// Change is a file that vendoring would add ("A"), modify ("M") or delete
+// ("D"). Its path is relative to the project dir.
+type Change struct {
+	Op   string
+	Path string
+}
+
+func (c Change) String() string {
+	return c.Op + " " + c.Path
+}
+
+// Check vendors into a scratch dir and compares the result with the target
+// dir, the lock and (with Modules) go.mod, leaving all of them alone. No
+// changes means the target dir is up to date with the conf file.
+func Check(opts Options) ([]Change, error) {
+	if opts.Keep {
+		return nil, errors.New("check can't keep the checked out files")
+	}
+	opts, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	dir, targetDir := opts.Dir, opts.TargetDir
+
+	scratch, err := ioutil.TempDir("", "trash-check")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+
+	scratchOpts := opts
+	scratchOpts.TargetDir = filepath.Join(scratch, "vendor")
+	scratchOpts.OutLockFile = filepath.Join(scratch, LockFile)
+	scratchOpts.OutModFile = filepath.Join(scratch, "go.mod")
+	scratchOpts.otherTargets = append(opts.otherTargets, targetDir)
+	if err := Vendor(scratchOpts); err != nil {
+		return nil, errors.Wrapf(err, "Vendoring into '%s' failed", scratch)
+	}
+
+	var changes []Change
+	diff := func(expected, actual string) error {
+		name, err := filepath.Rel(dir, actual)
+		if err != nil {
+			return err
+		}
+		expectedFiles, err := hashPath(expected)
+		if err != nil {
+			return err
+		}
+		actualFiles, err := hashPath(actual)
+		if err != nil {
+			return err
+		}
+		modified, missing, extra := diffFiles(expectedFiles, actualFiles)
+		for _, f := range modified {
+			changes = append(changes, Change{"M", filepath.Join(name, f)})
+		}
+		for _, f := range missing {
+			changes = append(changes, Change{"A", filepath.Join(name, f)})
+		}
+		for _, f := range extra {
+			changes = append(changes, Change{"D", filepath.Join(name, f)})
+		}
+		return nil
+	}
+
+	if err := diff(scratchOpts.TargetDir, targetDir); err != nil {
+		return nil, err
+	}
+	if err := diff(scratchOpts.OutLockFile, filepath.Join(dir, LockFile)); err != nil {
+		return nil, err
+	}
+	if opts.Modules {
+		if err := diff(scratchOpts.OutModFile, filepath.Join(dir, "go.mod")); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// hashPath hashes a file or all files in a dir. A file is keyed by "", and
+// a path that doesn't exist has no files.
+func hashPath(p string) (map[string]string, error) {
+	info, err := os.Lstat(p)
+	switch {
+	case os.IsNotExist(err):
+		return map[string]string{}, nil
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		return util.HashFiles(p, nil)
+	}
+	sum, err := util.HashFile(p, info)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"": sum}, nil
+}
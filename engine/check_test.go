@@ -0,0 +1,92 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashPath(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-check")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "vendor", "pkg"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "vendor", "pkg", "a.go"), []byte("package pkg\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, LockFile), []byte("package: foo\n"), 0644))
+
+	files, err := hashPath(filepath.Join(dir, "vendor"))
+	assert.NoError(err)
+	assert.Contains(files, "pkg/a.go")
+
+	files, err = hashPath(filepath.Join(dir, LockFile))
+	assert.NoError(err)
+	assert.Len(files, 1)
+	assert.NotEmpty(files[""])
+
+	files, err = hashPath(filepath.Join(dir, "go.mod"))
+	assert.NoError(err)
+	assert.Empty(files)
+}
+
+func TestCheck(t *testing.T) {
+	assert := require.New(t)
+
+	remote := &fakeRemote{
+		commits: []fakeCommit{{
+			id:   "c1",
+			time: time.Unix(1, 0).UTC(),
+			tags: []string{"v1.0.0"},
+			files: map[string]string{
+				"fake.go": "package fake\n\nconst S = \"one\"\n",
+				"util.go": "package fake\n\nfunc U() {}\n",
+			},
+		}},
+	}
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": remote})()
+
+	dir, err := ioutil.TempDir("", "trash-check")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"example.com/fake\"\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "vendor.conf"), []byte("example.com/proj\n\nexample.com/fake v1.0.0 fake://fake vcs=fake\n"), 0644))
+	opts := Options{Dir: dir, CacheDir: filepath.Join(dir, ".cache"), Jobs: 1}
+	assert.NoError(Vendor(opts))
+
+	changes, err := Check(opts)
+	assert.NoError(err)
+	assert.Empty(changes)
+
+	fake := filepath.Join(dir, "vendor", "example.com", "fake")
+	assert.NoError(ioutil.WriteFile(filepath.Join(fake, "fake.go"), []byte("package fake\n\nconst S = \"two\"\n"), 0644))
+	assert.NoError(os.Remove(filepath.Join(fake, "util.go")))
+	assert.NoError(ioutil.WriteFile(filepath.Join(fake, "extra.go"), []byte("package fake\n"), 0644))
+
+	vendorBefore, err := hashPath(filepath.Join(dir, "vendor"))
+	assert.NoError(err)
+	lockBefore, err := hashPath(filepath.Join(dir, LockFile))
+	assert.NoError(err)
+	assert.NotEmpty(lockBefore)
+
+	changes, err = Check(opts)
+	assert.NoError(err)
+	assert.Equal([]Change{
+		{"M", "vendor/example.com/fake/fake.go"},
+		{"A", "vendor/example.com/fake/util.go"},
+		{"D", "vendor/example.com/fake/extra.go"},
+	}, changes)
+
+	vendorAfter, err := hashPath(filepath.Join(dir, "vendor"))
+	assert.NoError(err)
+	assert.Equal(vendorBefore, vendorAfter)
+	lockAfter, err := hashPath(filepath.Join(dir, LockFile))
+	assert.NoError(err)
+	assert.Equal(lockBefore, lockAfter)
+}
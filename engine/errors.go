@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoRootPackage is the cause of the errors guessing the root package,
+// which should be in the conf file instead.
+var ErrNoRootPackage = errors.New("could not guess the root package: specify it in the conf file")
+
+// ErrInterrupted is the cause of the errors of operations stopped by closing
+// Options.Cancel. Nothing they would have changed has changed.
+var ErrInterrupted = errors.New("interrupted: left everything as it was")
+
+// ConfError is a problem with an import, or the lack of it, in the conf file.
+type ConfError struct {
+	ConfFile string
+	Package  string
+	Reason   string
+}
+
+func (e *ConfError) Error() string {
+	return fmt.Sprintf("%s: package '%s' %s", e.ConfFile, e.Package, e.Reason)
+}
+
+// PackageError is a failure to get an import into the cache or out of it.
+type PackageError struct {
+	Package string
+	Err     error
+}
+
+func (e *PackageError) Error() string {
+	return fmt.Sprintf("'%s': %v", e.Package, e.Err)
+}
+
+func (e *PackageError) Cause() error  { return e.Err }
+func (e *PackageError) Unwrap() error { return e.Err }
+
+// OfflineError lists what the imports need that isn't in the cache, when
+// trash is offline: the repos it would clone and the commits it would fetch.
+type OfflineError struct {
+	Missing []*PackageError
+}
+
+func (e *OfflineError) Error() string {
+	lines := []string{"offline, and missing from the cache:"}
+	for _, m := range e.Missing {
+		lines = append(lines, "  "+m.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notCachedError is something that isn't in the cache, and can't be fetched
+// because trash is offline.
+type notCachedError string
+
+func (e notCachedError) Error() string {
+	return string(e) + " is not in the cache"
+}
+
+// GitError is a git command that failed.
+type GitError struct {
+	Dir    string
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *GitError) Error() string {
+	msg := fmt.Sprintf("`git %s` failed in '%s': %v", strings.Join(e.Args, " "), e.Dir, e.Err)
+	if e.Output != "" {
+		msg += ":\n" + e.Output
+	}
+	return msg
+}
+
+func (e *GitError) Cause() error  { return e.Err }
+func (e *GitError) Unwrap() error { return e.Err }
+
+// runGit runs git in dir, returning its output or a *GitError.
+func runGit(dir string, args ...string) ([]byte, error) {
+	bytes, err := gitCommand(dir, args...).CombinedOutput()
+	if err != nil {
+		return bytes, &GitError{Dir: dir, Args: args, Output: strings.TrimSpace(string(bytes)), Err: err}
+	}
+	return bytes, nil
+}
@@ -0,0 +1,46 @@
+package engine
+
+// EventKind tells what an Event is about.
+type EventKind string
+
+const (
+	// EventClone is sent when a repo is about to be cloned into the cache.
+	EventClone EventKind = "clone"
+	// EventFetch is sent when the commits of a remote are about to be fetched.
+	EventFetch EventKind = "fetch"
+	// EventResolve is sent when a version constraint resolved to the tag in Version.
+	EventResolve EventKind = "resolve"
+	// EventCheckout is sent when Version is about to be checked out in the cache.
+	EventCheckout EventKind = "checkout"
+	// EventCopy is sent when a package has been copied to Path in the target dir.
+	EventCopy EventKind = "copy"
+	// EventRemove is sent when Path has been removed from the target dir.
+	EventRemove EventKind = "remove"
+	// EventWrite is sent when the file at Path has been written.
+	EventWrite EventKind = "write"
+)
+
+// Event reports the progress of an operation.
+type Event struct {
+	Kind    EventKind
+	Package string
+	Version string
+	Path    string
+}
+
+// Listener gets the events of an operation. Imports are worked on
+// concurrently, so OnEvent can be called from several goroutines at once.
+type Listener interface {
+	OnEvent(e Event)
+}
+
+// ListenerFunc makes a Listener out of a func.
+type ListenerFunc func(e Event)
+
+func (f ListenerFunc) OnEvent(e Event) {
+	f(e)
+}
+
+type nopListener struct{}
+
+func (nopListener) OnEvent(Event) {}
@@ -0,0 +1,353 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gitRepo is a git repo in the cache. Its objects and refs are kept in a
+// bare repo, its store, keyed by the URL it's fetched from; the dir of the
+// import is a worktree of the store, which is never checked out: commits are
+// exported through an index of their own. A fork borrows the objects of the
+// store the import came from before, so switching to it only fetches what
+// the fork adds.
+type gitRepo struct {
+	c   *cache
+	dir string
+	i   conf.Import
+}
+
+func newGitRepo(c *cache, dir string, i conf.Import) repo {
+	return &gitRepo{c: c, dir: dir, i: i}
+}
+
+// gitCommand runs git in dir, so that repos can be worked on concurrently.
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+func (r *gitRepo) prepare() error {
+	logrus.WithFields(logrus.Fields{"repoDir": r.dir, "i": r.i}).Debug("checkGitRepo")
+	current := r.store()
+	url := r.i.Repo
+	if url == "" && current != "" && (r.lookedUp(current) || r.c.offline) {
+		url, _ = r.remoteURL()
+	}
+	if url == "" && r.c.offline {
+		return notCachedError("the repo")
+	}
+	lookedUp := url == ""
+	if lookedUp {
+		root, err := r.inMirror()
+		if err != nil {
+			return err
+		}
+		if root != "" {
+			url = "https://" + root
+		} else {
+			logrus.Infof("Looking up the repo of '%s'", r.i.Package)
+			found, err := lookUpImport(r.i.Package, r.c.insecure, r.c.cancel)
+			if err != nil {
+				return err
+			}
+			if found.VCS != "git" {
+				return r.handOff(found)
+			}
+			root, url = found.Root, found.Repo
+		}
+		if root != r.i.Package {
+			// the import is a package inside the repo
+			r.i.Package, r.dir = root, r.c.cloneDir(root)
+		}
+	}
+
+	store := r.c.storeDir(url)
+	unlock, err := r.c.lock(store)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if current = r.store(); current == store {
+		return nil
+	}
+	if _, err := os.Stat(store); os.IsNotExist(err) {
+		if r.c.offline {
+			return notCachedError(fmt.Sprintf("the repo from '%s'", url))
+		}
+		if err := r.initStore(store, url, current); err != nil {
+			os.RemoveAll(store)
+			return err
+		}
+	}
+	if lookedUp && !r.lookedUp(store) {
+		if _, err := runGit(store, "config", "--add", "trash.goget", r.i.Package); err != nil {
+			return err
+		}
+	}
+	return r.addWorktree(store)
+}
+
+// handOff prepares the repo of the import found by a lookup to be of
+// another kind of VCS than git, with the backend of that kind, in the dir of
+// the root of the repo.
+func (r *gitRepo) handOff(found importRoot) error {
+	newRepo, ok := backends[found.VCS]
+	if !ok || found.VCS == "proxy" {
+		return fmt.Errorf("it's in the %s repo at %s, which trash can't get", found.VCS, found.Repo)
+	}
+	logrus.Infof("'%s' is in the %s repo at %s", r.i.Package, found.VCS, found.Repo)
+	i := r.i
+	i.Package, i.Repo = found.Root, found.Repo
+	return newRepo(r.c, r.c.cloneDir(found.Root), i).prepare()
+}
+
+// store returns the store the dir of the import is a worktree of, or "" if
+// it isn't a worktree of the cache.
+func (r *gitRepo) store() string {
+	if info, err := os.Stat(filepath.Join(r.dir, ".git")); err != nil || info.IsDir() {
+		return ""
+	}
+	bytes, err := gitCommand(r.dir, "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		logrus.Debugf("Not in a git repo: `git rev-parse --git-common-dir` in dir %s failed: %s", r.dir, err)
+		return ""
+	}
+	store := strings.TrimSpace(string(bytes))
+	if !filepath.IsAbs(store) {
+		store = filepath.Join(r.dir, store)
+	}
+	if !strings.HasPrefix(store, r.c.storeRoot()+"/") {
+		return ""
+	}
+	return filepath.Clean(store)
+}
+
+// lookedUp tells whether store was looked up for the import, from its
+// import path or in a mirror.
+func (r *gitRepo) lookedUp(store string) bool {
+	for l := range util.CmdOutLines(gitCommand(store, "config", "--get-all", "trash.goget")) {
+		if strings.TrimSpace(l) == r.i.Package {
+			return true
+		}
+	}
+	return false
+}
+
+// initStore creates the store of url, borrowing the objects of the store the
+// import was in before, if any, and fetches into it.
+func (r *gitRepo) initStore(store, url, previous string) error {
+	logrus.Infof("Preparing cache for '%s'", r.i.Package)
+	r.c.events.OnEvent(Event{Kind: EventClone, Package: r.i.Package})
+	if err := os.MkdirAll(store, 0755); err != nil {
+		return err
+	}
+	if _, err := runGit(store, "init", "-q", "--bare"); err != nil {
+		return err
+	}
+	if _, err := runGit(store, "remote", "add", "origin", url); err != nil {
+		return err
+	}
+	if previous != "" {
+		alternates := filepath.Join(store, "objects", "info", "alternates")
+		if err := ioutil.WriteFile(alternates, []byte(filepath.Join(previous, "objects")+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return r.fetchFrom(store, url)
+}
+
+// addWorktree replaces the dir of the import with a worktree of store.
+func (r *gitRepo) addWorktree(store string) error {
+	logrus.WithFields(logrus.Fields{"repoDir": r.dir, "store": store}).Debug("adding worktree")
+	if err := os.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.dir), 0755); err != nil {
+		return err
+	}
+	if _, err := runGit(store, "worktree", "prune"); err != nil {
+		return err
+	}
+	bytes, err := runGit(store, "for-each-ref", "--count=1", "--format=%(objectname)", "refs/remotes", "refs/tags")
+	if err != nil {
+		return err
+	}
+	commit := strings.TrimSpace(string(bytes))
+	if commit == "" {
+		return fmt.Errorf("no commits in '%s'", store)
+	}
+	_, err = runGit(store, "worktree", "add", "-q", "--detach", "--no-checkout", r.dir, commit)
+	return err
+}
+
+func (r *gitRepo) fetch() error {
+	if store := r.store(); store != "" {
+		unlock, err := r.c.lock(store)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	url, err := r.remoteURL()
+	if err != nil {
+		return err
+	}
+	return r.fetchFrom(r.dir, url)
+}
+
+// fetchFrom fetches the branches and tags of origin, at url, into dir; from
+// its mirror if there is one, so that origin keeps the URL.
+func (r *gitRepo) fetchFrom(dir, url string) error {
+	remote := "origin"
+	if mirror, ok := r.c.mirrors.rewrite(url); ok {
+		if _, err := runGit(dir, "fetch", "-f", "-t", mirror, "+refs/heads/*:refs/remotes/origin/*"); err != nil {
+			return err
+		}
+		remote = mirror
+	} else if _, err := runGit(dir, "fetch", "-f", "-t", "origin"); err != nil {
+		return err
+	}
+	return r.setHead(dir, remote)
+}
+
+// setHead points origin/HEAD at the default branch of remote, which its HEAD
+// symref names. It's left alone if the remote doesn't say.
+func (r *gitRepo) setHead(dir, remote string) error {
+	bytes, err := runGit(dir, "ls-remote", "--symref", remote, "HEAD")
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(string(bytes), "\n") {
+		f := strings.Fields(l)
+		if len(f) == 3 && f[0] == "ref:" && f[2] == "HEAD" && strings.HasPrefix(f[1], "refs/heads/") {
+			_, err := runGit(dir, "symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/"+strings.TrimPrefix(f[1], "refs/heads/"))
+			return err
+		}
+	}
+	logrus.Debugf("No default branch for '%s'", r.i.Package)
+	return nil
+}
+
+// inMirror finds the repo of an import without one in the mirror its package
+// is matched by, trying the package and then the dirs up from it. It returns
+// the import path of the repo, or "" if no mirror matches the package.
+func (r *gitRepo) inMirror() (string, error) {
+	if _, ok := r.c.mirrors.lookup(r.i.Package); !ok {
+		return "", nil
+	}
+	logrus.Infof("Looking up the repo of '%s' in its mirror", r.i.Package)
+	for root := r.i.Package; root != "." && root != "/"; root = path.Dir(root) {
+		mirror, ok := r.c.mirrors.lookup(root)
+		if !ok {
+			break
+		}
+		cmd := gitCommand(r.c.work, "ls-remote", "-h", mirror)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		if err := cmd.Run(); err == nil {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("could not find out where to get it from: no repo for it in its mirror")
+}
+
+func (r *gitRepo) branch(name string) (string, bool) {
+	if name == defaultBranch {
+		err := gitCommand(r.dir, "rev-parse", "-q", "--verify", "refs/remotes/origin/HEAD").Run()
+		return "origin/HEAD", err == nil
+	}
+	b := "origin/" + name
+	logrus.Debugf("Checking if '%s' is a branch", b)
+	for l := range util.CmdOutLines(gitCommand(r.dir, "branch", "--list", "-r", b)) {
+		if strings.TrimSpace(l) == b {
+			return b, true
+		}
+	}
+	return b, false
+}
+
+func (r *gitRepo) export(ref, dest string) error {
+	tmp, err := ioutil.TempDir(r.c.work, "index")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"--work-tree=" + dest, "read-tree", ref},
+		{"--work-tree=" + dest, "checkout-index", "-a", "-f"},
+	} {
+		cmd := gitCommand(r.dir, args...)
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(tmp, "index"))
+		if bytes, err := cmd.CombinedOutput(); err != nil {
+			return &GitError{Dir: r.dir, Args: args, Output: strings.TrimSpace(string(bytes)), Err: err}
+		}
+	}
+	return nil
+}
+
+func (r *gitRepo) latest() (string, error) {
+	bytes, err := runGit(r.dir, "log", "--all", "--pretty=oneline", "--abbrev-commit", "-1")
+	if err != nil {
+		return "", err
+	}
+	if fields := strings.Fields(string(bytes)); len(fields) > 0 {
+		return fields[0], nil
+	}
+	return "", fmt.Errorf("no commits in '%s'", r.dir)
+}
+
+func (r *gitRepo) tags() ([]string, error) {
+	bytes, err := gitCommand(r.dir, "tag").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(bytes)), nil
+}
+
+func (r *gitRepo) revision(ref string) (revision, error) {
+	bytes, err := gitCommand(r.dir, "log", "-1", "--format=%H %ct", ref).Output()
+	if err != nil {
+		return revision{}, fmt.Errorf("`git log -1 %s` failed in '%s': %v", ref, r.dir, err)
+	}
+	fields := strings.Fields(string(bytes))
+	if len(fields) != 2 {
+		return revision{}, fmt.Errorf("unexpected `git log` output in '%s': %q", r.dir, bytes)
+	}
+	sec, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return revision{}, err
+	}
+	return revision{Commit: fields[0], Time: time.Unix(sec, 0).UTC()}, nil
+}
+
+func (r *gitRepo) remoteURL() (string, error) {
+	bytes, err := gitCommand(r.dir, "config", "--get", "remote.origin.url").Output()
+	if err != nil {
+		return "", fmt.Errorf("no url for remote 'origin' in '%s': %v", r.dir, err)
+	}
+	return strings.TrimSpace(string(bytes)), nil
+}
+
+func (r *gitRepo) behind(commit, ref string) (int, error) {
+	bytes, err := runGit(r.dir, "rev-list", "--count", commit+".."+ref)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(bytes)))
+}
@@ -0,0 +1,294 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// testGit runs git in dir, failing t if it fails.
+func testGit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@b", "GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@b")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestGitRepoFork(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	git := func(dir string, args ...string) {
+		testGit(t, dir, args...)
+	}
+	upstream, fork := filepath.Join(dir, "upstream"), filepath.Join(dir, "fork")
+	assert.NoError(os.Mkdir(upstream, 0755))
+	git(upstream, "init", "-q")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a\n"), 0644))
+	git(upstream, "add", "-A")
+	git(upstream, "commit", "-qm", "one")
+	git(upstream, "tag", "v1.0.0")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "b.go"), []byte("package a\n"), 0644))
+	git(upstream, "add", "-A")
+	git(upstream, "commit", "-qm", "two")
+	git(upstream, "tag", "v1.1.0")
+	git(dir, "clone", "-q", upstream, fork)
+	assert.NoError(ioutil.WriteFile(filepath.Join(fork, "c.go"), []byte("package a\n"), 0644))
+	git(fork, "add", "-A")
+	git(fork, "commit", "-qm", "three")
+	git(fork, "tag", "v1.2.0")
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	i := conf.Import{Package: "example.com/a", Version: "v1.0.0", Repo: upstream}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	assert.FileExists(filepath.Join(c.repoDir(i.Package), "a.go"))
+	assert.Equal(c.storeDir(upstream), (&gitRepo{c: c, dir: c.cloneDir(i.Package), i: i}).store())
+	_, err = os.Stat(filepath.Join(c.cloneDir(i.Package), "a.go"))
+	assert.True(os.IsNotExist(err), "the worktree in the cache is checked out")
+
+	// runs sharing the cache check out their own versions
+	var wg sync.WaitGroup
+	for k, version := range []string{"v1.0.0", "v1.1.0", "v1.0.0", "v1.1.0"} {
+		other := &cache{dir: c.dir, work: filepath.Join(dir, fmt.Sprint("work", k)), events: nopListener{}}
+		assert.NoError(os.Mkdir(other.work, 0755))
+		wg.Add(1)
+		go func(other *cache, i conf.Import) {
+			defer wg.Done()
+			assert.NoError(other.prepare(i))
+			assert.NoError(other.checkout(i))
+			_, err := os.Stat(filepath.Join(other.repoDir(i.Package), "b.go"))
+			assert.Equal(i.Version == "v1.0.0", os.IsNotExist(err), i.Version)
+		}(other, conf.Import{Package: i.Package, Version: version, Repo: upstream})
+	}
+	wg.Wait()
+
+	i.Version, i.Repo = "v1.2.0", fork
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	assert.FileExists(filepath.Join(c.repoDir(i.Package), "c.go"))
+	alternates, err := ioutil.ReadFile(filepath.Join(c.storeDir(fork), "objects", "info", "alternates"))
+	assert.NoError(err)
+	assert.Equal(filepath.Join(c.storeDir(upstream), "objects")+"\n", string(alternates))
+
+	remote, err := c.remote(conf.Import{Package: i.Package})
+	assert.NoError(err)
+	assert.Equal(fork, remote)
+}
+
+func TestGitRepoOffline(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.Mkdir(upstream, 0755))
+	testGit(t, upstream, "init", "-q")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a\n"), 0644))
+	testGit(t, upstream, "add", "-A")
+	testGit(t, upstream, "commit", "-qm", "one")
+	testGit(t, upstream, "tag", "v1.0.0")
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), offline: true, events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	i := conf.Import{Package: "example.com/a", Version: "v1.0.0", Repo: upstream}
+	err = c.prepare(i)
+	assert.IsType(&PackageError{}, err)
+	assert.IsType(notCachedError(""), err.(*PackageError).Err)
+	_, err = os.Stat(c.storeDir(upstream))
+	assert.True(os.IsNotExist(err), "nothing is cloned offline")
+
+	c.offline = false
+	assert.NoError(c.prepare(i))
+	c.offline = true
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	assert.FileExists(filepath.Join(c.repoDir(i.Package), "a.go"))
+
+	// tags made since aren't fetched
+	testGit(t, upstream, "tag", "v1.1.0")
+	err = c.checkout(conf.Import{Package: i.Package, Version: "v1.1.0", Repo: upstream})
+	assert.IsType(&PackageError{}, err)
+	assert.IsType(notCachedError(""), err.(*PackageError).Err)
+	tag, err := c.latestVersion(i)
+	assert.NoError(err)
+	assert.Equal("v1.0.0", tag)
+}
+
+func TestGitRepoMirror(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	mirror := filepath.Join(dir, "mirror", "example.com", "a")
+	assert.NoError(os.MkdirAll(filepath.Join(mirror, "sub"), 0755))
+	testGit(t, mirror, "init", "-q")
+	assert.NoError(ioutil.WriteFile(filepath.Join(mirror, "sub", "b.go"), []byte("package sub\n"), 0644))
+	testGit(t, mirror, "add", "-A")
+	testGit(t, mirror, "commit", "-qm", "one")
+	testGit(t, mirror, "tag", "v1.0.0")
+
+	mirrorsFile := filepath.Join(dir, "mirrors.yaml")
+	assert.NoError(ioutil.WriteFile(mirrorsFile, []byte("repos:\n- original: example.com\n  repo: file://"+filepath.Join(dir, "mirror", "example.com")+"\n"), 0644))
+	mirrors, err := loadMirrors(mirrorsFile)
+	assert.NoError(err)
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), mirrors: mirrors, events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+
+	// the repo of a package without one is looked up in the mirror
+	i := conf.Import{Package: "example.com/a/sub", Version: "v1.0.0"}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	assert.FileExists(filepath.Join(c.repoDir(i.Package), "b.go"))
+	remote, err := c.remote(i)
+	assert.NoError(err)
+	assert.Equal("https://example.com/a", remote, "the lock gets the canonical URL")
+
+	// fetching goes to the mirror too
+	testGit(t, mirror, "tag", "v1.1.0")
+	i = conf.Import{Package: "example.com/a", Version: "v1.1.0", Repo: "https://example.com/a.git"}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	remote, err = c.remote(i)
+	assert.NoError(err)
+	assert.Equal("https://example.com/a.git", remote)
+}
+
+func TestGitRepoLookUp(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.MkdirAll(filepath.Join(upstream, "sub"), 0755))
+	testGit(t, upstream, "init", "-q")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "sub", "b.go"), []byte("package sub\n"), 0644))
+	testGit(t, upstream, "add", "-A")
+	testGit(t, upstream, "commit", "-qm", "one")
+	testGit(t, upstream, "tag", "v1.0.0")
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<meta name="go-import" content="%s/a git %s">`, r.Host, upstream)
+	}))
+	defer server.Close()
+	defer func(c *http.Client) { metaClient = c }(metaClient)
+	metaClient = server.Client()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	i := conf.Import{Package: host + "/a/sub", Version: "v1.0.0"}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	assert.FileExists(filepath.Join(c.repoDir(i.Package), "b.go"))
+	remote, err := c.remote(i)
+	assert.NoError(err)
+	assert.Equal(upstream, remote)
+
+	// it's not looked up again
+	server.Close()
+	assert.NoError(c.prepare(conf.Import{Package: host + "/a", Version: "v1.0.0"}))
+}
+
+func TestGitRepoLookUpOtherVCS(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": {}})()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<meta name="go-import" content="%s/a fake fake://fake">`, r.Host)
+	}))
+	defer server.Close()
+	defer func(c *http.Client) { metaClient = c }(metaClient)
+	metaClient = server.Client()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	var cloned []string
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: ListenerFunc(func(e Event) {
+		if e.Kind == EventClone {
+			cloned = append(cloned, e.Package)
+		}
+	})}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	r := newGitRepo(c, c.cloneDir(host+"/a/sub"), conf.Import{Package: host + "/a/sub", Version: "v1.0.0"})
+	assert.NoError(r.prepare())
+	assert.Equal([]string{host + "/a"}, cloned)
+	assert.DirExists(c.cloneDir(host + "/a"))
+
+	// the repos of other VCS keep the URL they were looked up at
+	vcsDir := filepath.Join(dir, "hg")
+	assert.NoError(os.Mkdir(vcsDir, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(vcsDir, repoMarker), []byte("https://hg.example.com/a\n"), 0644))
+	url, err := backends["hg"](c, vcsDir, conf.Import{Package: host + "/a"}).remoteURL()
+	assert.NoError(err)
+	assert.Equal("https://hg.example.com/a", url)
+}
+
+func TestGitRepoDefaultBranch(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-git")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.Mkdir(upstream, 0755))
+	testGit(t, upstream, "init", "-q")
+	testGit(t, upstream, "symbolic-ref", "HEAD", "refs/heads/main")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a // main\n"), 0644))
+	testGit(t, upstream, "add", "-A")
+	testGit(t, upstream, "commit", "-qm", "main")
+	testGit(t, upstream, "checkout", "-qb", "develop")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a // develop\n"), 0644))
+	testGit(t, upstream, "commit", "-qam", "develop")
+	testGit(t, upstream, "checkout", "-q", "main")
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	checkout := func(version string) string {
+		c.checkedOut = nil
+		i := conf.Import{Package: "example.com/a", Version: version, Repo: upstream}
+		assert.NoError(c.prepare(i))
+		assert.NoError(c.checkout(i))
+		bytes, err := ioutil.ReadFile(filepath.Join(c.repoDir(i.Package), "a.go"))
+		assert.NoError(err)
+		return string(bytes)
+	}
+	assert.Equal("package a // main\n", checkout("HEAD"))
+	c.checkedOut = nil
+	assert.Error(c.checkout(conf.Import{Package: "example.com/a", Version: "master", Repo: upstream}), "there's no master branch")
+	assert.Equal("package a // develop\n", checkout("develop"))
+
+	testGit(t, upstream, "symbolic-ref", "HEAD", "refs/heads/develop")
+	assert.Equal("package a // develop\n", checkout("HEAD"))
+
+	testGit(t, upstream, "checkout", "-qb", "feature")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a // feature\n"), 0644))
+	testGit(t, upstream, "commit", "-qam", "feature")
+	assert.Equal("package a // feature\n", checkout("feature"), "the branch was made after the last fetch")
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rdeusser/trash/conf"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// forEachImport runs f for every import, at most jobs at a time. An import
+// nested in another one lives inside the other's repo dir in the cache, so
+// they're run one after the other, the outer one first.
+func forEachImport(imports []conf.Import, jobs int, f func(i conf.Import) error) error {
+	sorted := append(conf.Imports{}, imports...)
+	sort.Sort(sorted)
+
+	var groups [][]conf.Import
+	for _, i := range sorted {
+		nested := false
+		for k, group := range groups {
+			if strings.HasPrefix(i.Package, group[0].Package+"/") {
+				groups[k] = append(group, i)
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			groups = append(groups, []conf.Import{i})
+		}
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan struct{}, jobs)
+	var wg errgroup.Group
+	for _, group := range groups {
+		group := group
+		wg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			for _, i := range group {
+				if err := f(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return wg.Wait()
+}
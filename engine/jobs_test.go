@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachImport(t *testing.T) {
+	assert := require.New(t)
+
+	imports := []conf.Import{
+		{Package: "github.com/docker/docker/pkg/term"},
+		{Package: "github.com/docker/docker"},
+		{Package: "github.com/docker/docker-ce"},
+		{Package: "github.com/pkg/errors"},
+		{Package: "github.com/sirupsen/logrus"},
+		{Package: "golang.org/x/sys"},
+	}
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	var done []string
+	err := forEachImport(imports, 2, func(i conf.Import) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		done = append(done, i.Package)
+		mutex.Unlock()
+		return nil
+	})
+	assert.NoError(err)
+	assert.Len(done, len(imports))
+	assert.Equal(2, maxRunning)
+
+	index := map[string]int{}
+	for k, pkg := range done {
+		index[pkg] = k
+	}
+	assert.True(index["github.com/docker/docker"] < index["github.com/docker/docker/pkg/term"])
+
+	err = forEachImport(imports, 0, func(i conf.Import) error {
+		if i.Package == "golang.org/x/sys" {
+			return errors.New("no sys")
+		}
+		return nil
+	})
+	assert.EqualError(err, "no sys")
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// importRoot is where the repo of an import path is: the import path of the
+// root of the repo, its kind of VCS and its URL.
+type importRoot struct {
+	Root string
+	VCS  string
+	Repo string
+}
+
+// knownHosts are the hosts whose repos are at the first two elements of
+// their paths, which are git repos fetched over https.
+var knownHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"bitbucket.org": true,
+}
+
+// gopkgIn matches the import paths of gopkg.in: gopkg.in/pkg.vN is
+// github.com/go-pkg/pkg, and gopkg.in/user/pkg.vN is github.com/user/pkg,
+// at the tags and branches of major version N.
+var gopkgIn = regexp.MustCompile(`^gopkg\.in/(?:([a-zA-Z0-9][-a-zA-Z0-9]*)/)?([a-zA-Z][-.a-zA-Z0-9]*)\.v[0-9]+(?:-unstable)?(?:/|$)`)
+
+// majorElem matches the /vN element of the import paths of modules of major
+// version 2 and up.
+var majorElem = regexp.MustCompile(`^v(?:[2-9]|[1-9][0-9]+)$`)
+
+// metaClient gets the pages of import paths which tell where their repos are.
+var metaClient = &http.Client{Timeout: 30 * time.Second}
+
+// lookUpImport finds out where the repo of pkg is: from its host if it's a
+// known one or gopkg.in, or else from the go-import meta tags of the page at
+// https://<pkg>?go-get=1, or at http:// too with insecure. Closing cancel
+// stops getting the page, with ErrInterrupted.
+//
+// The root of a module of major version 2 and up, like github.com/foo/bar/v3,
+// has the /vN element, which is either a dir in its repo or not there at all.
+func lookUpImport(pkg string, insecure bool, cancel <-chan struct{}) (importRoot, error) {
+	found, err := lookUpRepo(pkg, insecure, cancel)
+	if err != nil {
+		return found, err
+	}
+	if rest := strings.Split(strings.TrimPrefix(pkg, found.Root+"/"), "/"); pkg != found.Root && majorElem.MatchString(rest[0]) {
+		found.Root += "/" + rest[0]
+	}
+	return found, nil
+}
+
+func lookUpRepo(pkg string, insecure bool, cancel <-chan struct{}) (importRoot, error) {
+	if m := gopkgIn.FindStringSubmatch(pkg); m != nil {
+		user := m[1]
+		if user == "" {
+			user = "go-" + m[2]
+		}
+		return importRoot{Root: strings.TrimSuffix(m[0], "/"), VCS: "git", Repo: "https://github.com/" + user + "/" + m[2]}, nil
+	}
+	elems := strings.Split(pkg, "/")
+	if elems[0] == "gopkg.in" {
+		return importRoot{}, fmt.Errorf("'%s' is not an import path of gopkg.in: it needs a .vN version after the package", pkg)
+	}
+	if knownHosts[elems[0]] {
+		if len(elems) < 3 {
+			return importRoot{}, fmt.Errorf("'%s' is not an import path of a repo on %s: it needs a user and a repo", pkg, elems[0])
+		}
+		root := strings.Join(elems[:3], "/")
+		return importRoot{Root: root, VCS: "git", Repo: "https://" + root}, nil
+	}
+	if !strings.Contains(elems[0], ".") {
+		return importRoot{}, fmt.Errorf("'%s' is not on the network: its first element has no dot", pkg)
+	}
+
+	imports, err := getMetaImports("https://"+pkg+"?go-get=1", pkg, cancel)
+	if err != nil && err != ErrInterrupted && insecure {
+		logrus.Warnf("Looking up '%s' over http: %v", pkg, err)
+		imports, err = getMetaImports("http://"+pkg+"?go-get=1", pkg, cancel)
+	}
+	if err != nil {
+		return importRoot{}, err
+	}
+	return matchMetaImport(pkg, imports)
+}
+
+// metaImport is a go-import meta tag.
+type metaImport struct {
+	Prefix, VCS, RepoRoot string
+}
+
+func getMetaImports(url, pkg string, cancel <-chan struct{}) ([]metaImport, error) {
+	logrus.Debugf("Getting '%s'", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up '%s': %v", pkg, err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		select {
+		case <-cancel:
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	resp, err := metaClient.Do(req.WithContext(ctx))
+	if err != nil {
+		select {
+		case <-cancel:
+			return nil, ErrInterrupted
+		default:
+		}
+		return nil, fmt.Errorf("could not look up '%s': %v", pkg, err)
+	}
+	defer resp.Body.Close()
+	imports, err := parseMetaGoImports(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up '%s': bad page at %s: %v", pkg, url, err)
+	}
+	if len(imports) == 0 && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not look up '%s': %s returned %s", pkg, url, resp.Status)
+	}
+	return imports, nil
+}
+
+// matchMetaImport picks the meta tag for pkg: the one whose prefix pkg is
+// in. Tags of the "mod" kind, for module proxies, only count when there's
+// no other.
+func matchMetaImport(pkg string, imports []metaImport) (importRoot, error) {
+	var match *metaImport
+	for k, m := range imports {
+		if !hasPathPrefix(pkg, m.Prefix) {
+			continue
+		}
+		if match != nil && match.VCS != "mod" && m.VCS != "mod" {
+			return importRoot{}, fmt.Errorf("could not look up '%s': more than one go-import meta tag for it (%s and %s)", pkg, match.Prefix, m.Prefix)
+		}
+		if match == nil || match.VCS == "mod" {
+			match = &imports[k]
+		}
+	}
+	if match == nil {
+		return importRoot{}, fmt.Errorf("could not look up '%s': no go-import meta tag for it", pkg)
+	}
+	if match.VCS == "mod" {
+		return importRoot{}, fmt.Errorf("could not look up '%s': it's only in the module proxy at %s, use vcs=proxy", pkg, match.RepoRoot)
+	}
+	return importRoot{Root: match.Prefix, VCS: match.VCS, Repo: match.RepoRoot}, nil
+}
+
+// parseMetaGoImports returns the go-import meta tags in the head of an HTML
+// page, which isn't expected to be valid XML.
+func parseMetaGoImports(r io.Reader) ([]metaImport, error) {
+	d := xml.NewDecoder(r)
+	d.CharsetReader = charsetReader
+	d.Strict = false
+	var imports []metaImport
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF || len(imports) > 0 {
+				return imports, nil
+			}
+			return nil, err
+		}
+		if e, ok := t.(xml.StartElement); ok && strings.EqualFold(e.Name.Local, "body") {
+			return imports, nil
+		}
+		if e, ok := t.(xml.EndElement); ok && strings.EqualFold(e.Name.Local, "head") {
+			return imports, nil
+		}
+		e, ok := t.(xml.StartElement)
+		if !ok || !strings.EqualFold(e.Name.Local, "meta") || attrValue(e.Attr, "name") != "go-import" {
+			continue
+		}
+		if f := strings.Fields(attrValue(e.Attr, "content")); len(f) == 3 {
+			imports = append(imports, metaImport{Prefix: f[0], VCS: f[1], RepoRoot: f[2]})
+		}
+	}
+}
+
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "ascii":
+		return input, nil
+	}
+	return nil, fmt.Errorf("can't read charset %s", charset)
+}
@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookUpImport(t *testing.T) {
+	assert := require.New(t)
+
+	pages := map[string]string{
+		"/vanity/foo": `<!DOCTYPE html>
+<html><head>
+<meta name="go-import" content="HOST/vanity/foo git https://git.example.com/foo.git">
+<meta name="go-source" content="HOST/vanity/foo _ _ _">
+</head><body><meta name="go-import" content="HOST/vanity/foo/sub git https://nope"></body></html>`,
+		"/vanity/hg":   `<meta name="go-import" content="HOST/vanity/hg hg https://hg.example.com/hg">`,
+		"/vanity/mod":  `<meta name="go-import" content="HOST/vanity/mod mod https://proxy.example.com">`,
+		"/vanity/both": `<meta name="go-import" content="HOST/vanity/both mod https://proxy.example.com"><meta name="go-import" content="HOST/vanity/both git https://git.example.com/both">`,
+		"/vanity/two":  `<meta name="go-import" content="HOST/vanity git https://git.example.com/a"><meta name="go-import" content="HOST/vanity/two git https://git.example.com/b">`,
+		"/vanity/none": `<html><head></head><body>nothing here</body></html>`,
+	}
+	var host string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("1", r.URL.Query().Get("go-get"))
+		for prefix, page := range pages {
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+				fmt.Fprint(w, strings.Replace(page, "HOST", host, -1))
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	host = strings.TrimPrefix(server.URL, "https://")
+	defer func(c *http.Client) { metaClient = c }(metaClient)
+	metaClient = server.Client()
+
+	for _, c := range []struct {
+		pkg  string
+		root importRoot
+		err  string
+	}{
+		{pkg: "github.com/foo/bar/baz", root: importRoot{Root: "github.com/foo/bar", VCS: "git", Repo: "https://github.com/foo/bar"}},
+		{pkg: "gitlab.com/foo/bar", root: importRoot{Root: "gitlab.com/foo/bar", VCS: "git", Repo: "https://gitlab.com/foo/bar"}},
+		{pkg: "github.com/foo/bar/v3/baz", root: importRoot{Root: "github.com/foo/bar/v3", VCS: "git", Repo: "https://github.com/foo/bar"}},
+		{pkg: "github.com/foo/bar/v1", root: importRoot{Root: "github.com/foo/bar", VCS: "git", Repo: "https://github.com/foo/bar"}},
+		{pkg: "gopkg.in/yaml.v2", root: importRoot{Root: "gopkg.in/yaml.v2", VCS: "git", Repo: "https://github.com/go-yaml/yaml"}},
+		{pkg: "gopkg.in/check.v1/sub", root: importRoot{Root: "gopkg.in/check.v1", VCS: "git", Repo: "https://github.com/go-check/check"}},
+		{pkg: "gopkg.in/src-d/go-git.v4-unstable", root: importRoot{Root: "gopkg.in/src-d/go-git.v4-unstable", VCS: "git", Repo: "https://github.com/src-d/go-git"}},
+		{pkg: "gopkg.in/yaml", err: ".vN"},
+		{pkg: "bitbucket.org/foo", err: "needs a user and a repo"},
+		{pkg: "local/foo", err: "no dot"},
+		{pkg: host + "/vanity/foo/sub/pkg", root: importRoot{Root: host + "/vanity/foo", VCS: "git", Repo: "https://git.example.com/foo.git"}},
+		{pkg: host + "/vanity/foo/v2", root: importRoot{Root: host + "/vanity/foo/v2", VCS: "git", Repo: "https://git.example.com/foo.git"}},
+		{pkg: host + "/vanity/hg", root: importRoot{Root: host + "/vanity/hg", VCS: "hg", Repo: "https://hg.example.com/hg"}},
+		{pkg: host + "/vanity/both", root: importRoot{Root: host + "/vanity/both", VCS: "git", Repo: "https://git.example.com/both"}},
+		{pkg: host + "/vanity/mod", err: "vcs=proxy"},
+		{pkg: host + "/vanity/two", err: "more than one"},
+		{pkg: host + "/vanity/none", err: "no go-import meta tag"},
+		{pkg: host + "/missing", err: "404"},
+	} {
+		root, err := lookUpImport(c.pkg, false, nil)
+		if c.err != "" {
+			assert.Error(err, c.pkg)
+			assert.Contains(err.Error(), c.err, c.pkg)
+			continue
+		}
+		assert.NoError(err, c.pkg)
+		assert.Equal(c.root, root, c.pkg)
+	}
+}
+
+func TestLookUpImportCancel(t *testing.T) {
+	assert := require.New(t)
+
+	done := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	defer func(c *http.Client) { metaClient = c }(metaClient)
+	metaClient = server.Client()
+
+	cancel := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancel) })
+	_, err := lookUpImport(strings.TrimPrefix(server.URL, "https://")+"/slow", false, cancel)
+	assert.Equal(ErrInterrupted, err)
+}
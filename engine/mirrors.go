@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/glide/mirrors"
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorRules rewrite where repos are fetched from. The original of a rule is
+// either a URL prefix, matched against the URL of a repo, or an import path
+// prefix, matched against the URL of a repo without its scheme and user
+// (github.com/foo/bar for git@github.com:foo/bar.git) and against the
+// packages without a repo. The longest original which matches wins. Only
+// fetching goes to the mirror: stores, the lock and go.mod keep the URL
+// the rule was applied to.
+type mirrorRules struct {
+	rules []*mirrors.MirrorRepo
+
+	mutex  sync.Mutex
+	logged map[string]bool
+}
+
+// loadMirrors reads the mirrors file at file, in the format of glide's
+// mirrors.yaml. There are no rules if there's no file.
+func loadMirrors(file string) (*mirrorRules, error) {
+	m := &mirrorRules{logged: map[string]bool{}}
+	if file == "" {
+		return m, nil
+	}
+	cfg, err := mirrors.ReadMirrorsFile(file)
+	if os.IsNotExist(err) {
+		logrus.Debugf("No mirrors file at '%s'", file)
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the mirrors file '%s': %v", file, err)
+	}
+	for _, r := range cfg.Repos {
+		if r.Original == "" || r.Repo == "" {
+			return nil, fmt.Errorf("%s: every mirror needs both an original and a repo", file)
+		}
+		m.rules = append(m.rules, r)
+	}
+	sort.SliceStable(m.rules, func(k, j int) bool { return len(m.rules[k].Original) > len(m.rules[j].Original) })
+	return m, nil
+}
+
+// isURL tells whether the original of a rule is a URL rather than an import
+// path: it has a scheme, or it's scp-like.
+func isURL(s string) bool {
+	if strings.Contains(s, "://") {
+		return true
+	}
+	colon := strings.Index(s, ":")
+	return colon > 0 && colon < strings.IndexAny(s+"/", "/")
+}
+
+// hasPathPrefix tells whether prefix is s or the start of s up to a slash.
+func hasPathPrefix(s, prefix string) bool {
+	return s == prefix || strings.HasPrefix(s, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// rewrite returns the mirror URL to fetch url from, and whether there is one.
+func (m *mirrorRules) rewrite(url string) (string, bool) {
+	if m == nil {
+		return url, false
+	}
+	p := replacementPath(url)
+	for _, r := range m.rules {
+		s := p
+		if isURL(r.Original) {
+			s = url
+		}
+		if hasPathPrefix(s, r.Original) {
+			mirror := join(r.Repo, s[len(strings.TrimSuffix(r.Original, "/")):])
+			m.log(url, mirror)
+			return mirror, true
+		}
+	}
+	return url, false
+}
+
+// lookup returns the mirror URL of the repo at the import path root, for
+// imports without a repo, and whether there is one.
+func (m *mirrorRules) lookup(root string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, r := range m.rules {
+		if !isURL(r.Original) && hasPathPrefix(root, r.Original) {
+			return join(r.Repo, root[len(strings.TrimSuffix(r.Original, "/")):]), true
+		}
+	}
+	return "", false
+}
+
+func (m *mirrorRules) log(url, mirror string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.logged[url] {
+		m.logged[url] = true
+		logrus.Infof("Fetching '%s' from mirror '%s'", url, mirror)
+	}
+}
+
+func join(repo, rest string) string {
+	if rest == "" {
+		return repo
+	}
+	return strings.TrimSuffix(repo, "/") + rest
+}
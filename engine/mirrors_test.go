@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrorRules(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-mirrors")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	m, err := loadMirrors(filepath.Join(dir, "missing.yaml"))
+	assert.NoError(err)
+	_, ok := m.rewrite("https://github.com/foo/bar")
+	assert.False(ok)
+
+	file := filepath.Join(dir, "mirrors.yaml")
+	assert.NoError(ioutil.WriteFile(file, []byte(`repos:
+- original: github.com
+  repo: https://git.corp/github
+- original: github.com/foo/special
+  repo: https://git.corp/special.git
+- original: https://go.googlesource.com/
+  repo: https://git.corp/google/
+`), 0644))
+	m, err = loadMirrors(file)
+	assert.NoError(err)
+
+	for _, c := range []struct{ url, mirror string }{
+		{"https://github.com/foo/bar", "https://git.corp/github/foo/bar"},
+		{"git@github.com:foo/bar.git", "https://git.corp/github/foo/bar"},
+		{"https://github.com/foo/special", "https://git.corp/special.git"},
+		{"https://go.googlesource.com/net", "https://git.corp/google/net"},
+		{"https://github.community/foo/bar", ""},
+		{"https://gitlab.com/github.com/bar", ""},
+	} {
+		mirror, ok := m.rewrite(c.url)
+		assert.Equal(c.mirror != "", ok, c.url)
+		if ok {
+			assert.Equal(c.mirror, mirror, c.url)
+		}
+	}
+
+	mirror, ok := m.lookup("github.com/foo/bar")
+	assert.True(ok)
+	assert.Equal("https://git.corp/github/foo/bar", mirror)
+	_, ok = m.lookup("go.googlesource.com/net")
+	assert.False(ok, "URL rules don't match import paths")
+
+	assert.NoError(ioutil.WriteFile(file, []byte("repos:\n- original: github.com\n"), 0644))
+	_, err = loadMirrors(file)
+	assert.Error(err)
+}
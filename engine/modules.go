@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/Masterminds/semver"
+	"github.com/sirupsen/logrus"
+)
+
+// revision is the commit an import has been checked out at, and where from.
+type revision struct {
+	Commit string
+	Time   time.Time
+	Remote string
+	Tag    string // what the version constraint resolved to, if any
+}
+
+var majorSuffix = regexp.MustCompile(`(?:/|^gopkg\.in/.*\.)(v[0-9]+)(?:-unstable)?$`)
+
+// moduleMajor returns the major version a module path is pinned to, like "v2"
+// for github.com/foo/bar/v2 or gopkg.in/yaml.v2, or "" if there is none.
+func moduleMajor(modPath string) string {
+	if m := majorSuffix.FindStringSubmatch(modPath); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// moduleVersion turns the version of an import into a version the go command
+// accepts: canonical semver tags are kept, anything else becomes a pseudo-version.
+func moduleVersion(i conf.Import, rev revision) (string, error) {
+	major := moduleMajor(i.Package)
+	version := i.Version
+	if rev.Tag != "" {
+		version = rev.Tag
+	}
+	if v, err := semver.NewVersion(version); err == nil && "v"+v.String() == version && v.Metadata() == "" {
+		if major == "" && v.Major() >= 2 {
+			return version + "+incompatible", nil
+		}
+		if major == "" || major == fmt.Sprintf("v%d", v.Major()) {
+			return version, nil
+		}
+	}
+	if isVersion(rev.Commit) {
+		return rev.Commit, nil // the commits of modules from a proxy are their versions
+	}
+	if rev.Commit == "" {
+		return "", fmt.Errorf("no commit known for '%s' at '%s'", i.Package, version)
+	}
+	if major == "" || major == "v1" {
+		major = "v0"
+	}
+	return fmt.Sprintf("%s.0.0-%s-%s", major, rev.Time.UTC().Format("20060102150405"), rev.Commit[:12]), nil
+}
+
+// modVersion returns the module version of the version of i, which is in
+// the cache, for a go.mod conf file.
+func (p *project) modVersion(i conf.Import) (string, error) {
+	tag, err := p.cache.resolveTag(i)
+	if err != nil {
+		return "", err
+	}
+	rev := revision{Tag: tag}
+	if !isVersion(tag) && !isVersion(i.Version) {
+		ref := i.Version
+		if tag != "" {
+			ref = tag
+		} else if b, ok := p.cache.branch(i, ref); ok {
+			ref = b
+		}
+		if rev, err = p.cache.revision(i, ref); err != nil {
+			return "", &PackageError{Package: i.Package, Err: err}
+		}
+		rev.Tag = tag
+	}
+	return moduleVersion(i, rev)
+}
+
+// replacementPath turns a repo URL into something go.mod accepts as a replacement.
+func replacementPath(repo string) string {
+	if filepath.IsAbs(repo) || strings.HasPrefix(repo, ".") {
+		return repo
+	}
+	p := repo
+	if k := strings.Index(p, "://"); k >= 0 {
+		p = p[k+3:]
+	} else if k := strings.Index(p, ":"); k >= 0 {
+		p = p[:k] + "/" + p[k+1:] // scp-like syntax: git@github.com:foo/bar.git
+	}
+	if k := strings.Index(p, "@"); k >= 0 && k < strings.Index(p, "/") {
+		p = p[k+1:]
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(p, "/"), ".git")
+}
+
+// vendoredPackages maps every import to the Go packages left of it in targetDir.
+func vendoredPackages(targetDir string, imports []conf.Import) (map[string][]string, error) {
+	owners := make([]string, 0, len(imports))
+	for _, i := range imports {
+		owners = append(owners, i.Package)
+	}
+	// longest first, so nested imports win over their parents
+	sort.Slice(owners, func(k, j int) bool { return len(owners[k]) > len(owners[j]) })
+
+	seen := map[string]bool{}
+	r := map[string][]string{}
+	err := filepath.Walk(targetDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == targetDir {
+			return nil
+		}
+		if info.IsDir() {
+			if name := info.Name(); name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(p, ".go") || strings.HasSuffix(p, "_test.go") {
+			return nil
+		}
+		pkg := filepath.ToSlash(filepath.Dir(p)[len(targetDir)+1:])
+		if seen[pkg] {
+			return nil
+		}
+		seen[pkg] = true
+		for _, owner := range owners {
+			if pkg == owner || strings.HasPrefix(pkg, owner+"/") {
+				r[owner] = append(r[owner], pkg)
+				return nil
+			}
+		}
+		logrus.Warnf("Package '%s' does not belong to any import, leaving it out of modules.txt", pkg)
+		return nil
+	})
+	for _, ps := range r {
+		sort.Strings(ps)
+	}
+	return r, err
+}
+
+func goVersion() string {
+	v := strings.TrimPrefix(runtime.Version(), "go")
+	if parts := strings.SplitN(v, ".", 3); len(parts) >= 2 && !strings.Contains(v, "devel") {
+		return parts[0] + "." + strings.TrimFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' })
+	}
+	return "1.14"
+}
+
+// writeModules makes the target dir usable with `go build -mod=vendor`: it
+// writes the go.mod require and replace blocks to OutModFile and a matching
+// modules.txt.
+func (p *project) writeModules(revisions map[string]revision) error {
+	rootPackage, err := p.rootPackage()
+	if err != nil {
+		return err
+	}
+	trashConf, vendorDir, outModFile := p.trashConf, p.opts.TargetDir, p.opts.OutModFile
+	modFile := filepath.Join(p.opts.Dir, "go.mod")
+	if _, err := os.Stat(outModFile); err == nil {
+		modFile = outModFile // go.mod is the conf file, written earlier in the run
+	}
+
+	m := &conf.GoMod{Module: rootPackage, Go: goVersion()}
+	indirect := map[string]bool{}
+	if file, err := os.Open(modFile); err == nil {
+		old, err := conf.ParseGoMod(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		m.Go = old.Go
+		m.Exclude = old.Exclude
+		for _, r := range old.Require {
+			indirect[r.Path] = r.Indirect
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	packages, err := vendoredPackages(vendorDir, trashConf.Imports)
+	if err != nil {
+		return err
+	}
+
+	txtFile := filepath.Join(vendorDir, "modules.txt")
+	os.Remove(txtFile) // it may be a hardlink to the one in the target dir being replaced
+	txt, err := os.Create(txtFile)
+	if err != nil {
+		return err
+	}
+	defer txt.Close()
+	w := bufio.NewWriter(txt)
+
+	for _, i := range trashConf.Imports {
+		pkgs := packages[i.Package]
+		if len(pkgs) == 0 {
+			continue
+		}
+		version, err := moduleVersion(i, revisions[i.Package])
+		if err != nil {
+			return err
+		}
+		m.Require = append(m.Require, conf.ModuleVersion{Path: i.Package, Version: version, Indirect: indirect[i.Package]})
+		header := fmt.Sprintf("# %s %s", i.Package, version)
+		if i.Repo != "" && i.VCS != "proxy" {
+			rep := conf.Replacement{
+				Old: conf.ModuleVersion{Path: i.Package, Version: version},
+				New: conf.ModuleVersion{Path: replacementPath(i.Repo)},
+			}
+			if !filepath.IsAbs(rep.New.Path) && !strings.HasPrefix(rep.New.Path, ".") {
+				rep.New.Version = version
+			}
+			m.Replace = append(m.Replace, rep)
+			header = strings.TrimSpace(fmt.Sprintf("%s => %s %s", header, rep.New.Path, rep.New.Version))
+		}
+		fmt.Fprintln(w, header)
+		fmt.Fprintln(w, "## explicit")
+		for _, p := range pkgs {
+			fmt.Fprintln(w, p)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	gomod, err := os.Create(outModFile)
+	if err != nil {
+		return err
+	}
+	defer gomod.Close()
+	logrus.Infof("Writing '%s' and '%s'", filepath.Base(outModFile), filepath.Join(filepath.Base(vendorDir), "modules.txt"))
+	if err := m.Write(gomod); err != nil {
+		return err
+	}
+	p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: txtFile})
+	p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: outModFile})
+	return nil
+}
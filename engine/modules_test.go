@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleVersion(t *testing.T) {
+	assert := require.New(t)
+	rev := revision{Commit: "6ec70d6a5542d5c2ad5b6ed1ba0b0e4b5b2e67d4", Time: time.Date(2019, 7, 10, 14, 34, 15, 0, time.UTC)}
+
+	for _, c := range []struct {
+		pkg, version, expected string
+	}{
+		{"github.com/pkg/errors", "v0.8.1", "v0.8.1"},
+		{"github.com/docker/docker", "v17.03.2-ce", "v0.0.0-20190710143415-6ec70d6a5542"},
+		{"github.com/docker/distribution", "v2.7.1", "v2.7.1+incompatible"},
+		{"github.com/go-chi/chi/v4", "v4.0.2", "v4.0.2"},
+		{"github.com/go-chi/chi/v4", "v3.3.0", "v4.0.0-20190710143415-6ec70d6a5542"},
+		{"gopkg.in/yaml.v2", "v2.2.2", "v2.2.2"},
+		{"gopkg.in/yaml.v2", "master", "v2.0.0-20190710143415-6ec70d6a5542"},
+		{"golang.org/x/sys", "6ec70d6a5542", "v0.0.0-20190710143415-6ec70d6a5542"},
+		{"github.com/pkg/errors", "0.8.1", "v0.0.0-20190710143415-6ec70d6a5542"},
+	} {
+		v, err := moduleVersion(conf.Import{Package: c.pkg, Version: c.version}, rev)
+		assert.NoError(err)
+		assert.Equal(c.expected, v, "%s@%s", c.pkg, c.version)
+	}
+
+	tagged := rev
+	tagged.Tag = "v0.9.1"
+	v, err := moduleVersion(conf.Import{Package: "github.com/pkg/errors", Version: "^0.9"}, tagged)
+	assert.NoError(err)
+	assert.Equal("v0.9.1", v)
+
+	_, err = moduleVersion(conf.Import{Package: "golang.org/x/sys", Version: "master"}, revision{})
+	assert.Error(err)
+}
+
+func TestModVersion(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-modules")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(os.Mkdir(upstream, 0755))
+	testGit(t, upstream, "init", "-q", "-b", "main")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "a.go"), []byte("package a\n"), 0644))
+	testGit(t, upstream, "add", "-A")
+	testGit(t, upstream, "commit", "-qm", "one")
+	testGit(t, upstream, "tag", "v1.0.0")
+	assert.NoError(ioutil.WriteFile(filepath.Join(upstream, "b.go"), []byte("package a\n"), 0644))
+	testGit(t, upstream, "add", "-A")
+	testGit(t, upstream, "commit", "-qm", "two")
+	cmd := exec.Command("git", "-C", upstream, "log", "-1", "--format=%H %cd", "--date=format-local:%Y%m%d%H%M%S")
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	out, err := cmd.Output()
+	assert.NoError(err)
+	head := strings.Fields(string(out))
+	pseudo := "v0.0.0-" + head[1] + "-" + head[0][:12]
+
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+	p := &project{cache: c}
+	for version, expected := range map[string]string{
+		"v1.0.0":      "v1.0.0",
+		"^1.0":        "v1.0.0",
+		"main":        pseudo,
+		defaultBranch: pseudo,
+		head[0]:       pseudo,
+	} {
+		i := conf.Import{Package: "example.com/a", Version: version, Repo: upstream}
+		assert.NoError(c.prepare(i))
+		v, err := p.modVersion(i)
+		assert.NoError(err, version)
+		assert.Equal(expected, v, version)
+	}
+}
+
+func TestReplacementPath(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal("github.com/imikushin/logrus", replacementPath("https://github.com/imikushin/logrus.git"))
+	assert.Equal("github.com/imikushin/logrus", replacementPath("git@github.com:imikushin/logrus.git"))
+	assert.Equal("git.example.com/logrus", replacementPath("ssh://git@git.example.com/logrus"))
+	assert.Equal("/src/logrus", replacementPath("/src/logrus"))
+}
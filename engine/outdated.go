@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"sync"
+
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/Masterminds/semver"
+	"github.com/sirupsen/logrus"
+)
+
+// OutdatedImport is what Outdated found about an import.
+type OutdatedImport struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	// Tag is what a version constraint resolved to, in trash.lock
+	Tag         string `json:"tag,omitempty"`
+	LatestPatch string `json:"latestPatch,omitempty"`
+	LatestMinor string `json:"latestMinor,omitempty"`
+	LatestMajor string `json:"latestMajor,omitempty"`
+	// Behind is how many commits a branch has moved past the commit in trash.lock
+	Behind *int `json:"behind,omitempty"`
+}
+
+// Outdated finds, for every import, the newer tags its repo has and how far
+// behind the lock the imports following a branch are.
+func Outdated(opts Options) ([]OutdatedImport, error) {
+	p, err := loadProject(opts, false)
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	var mutex sync.Mutex
+	found := map[string]OutdatedImport{}
+	if err := forEachImport(p.trashConf.Imports, p.opts.Jobs, p.cancelable(func(i conf.Import) error {
+		if err := p.cache.prepare(i); err != nil {
+			return err
+		}
+		tags, err := p.cache.semverTags(i)
+		if err != nil {
+			return err
+		}
+		o := OutdatedImport{Package: i.Package, Version: i.Version}
+		l, locked := p.lock.Get(i.Package)
+		current := i.Version
+		if _, ok := conf.ParseConstraint(i.Version); ok && locked && l.Version == i.Version {
+			o.Tag = l.Tag
+			current = l.Tag
+		}
+		o.LatestPatch, o.LatestMinor, o.LatestMajor = latestVersions(current, tags)
+
+		if locked && l.Commit != "" {
+			if b, ok := p.cache.branch(i, i.Version); ok || i.Version == defaultBranch {
+				behind, err := p.cache.behind(i, l.Commit, b)
+				if err != nil {
+					logrus.Debugf("Could not count the commits '%s' is behind: %v", i.Package, err)
+				} else {
+					o.Behind = &behind
+				}
+			}
+		}
+		mutex.Lock()
+		found[i.Package] = o
+		mutex.Unlock()
+		return nil
+	})); err != nil {
+		return nil, err
+	}
+
+	report := []OutdatedImport{}
+	for _, i := range p.trashConf.Imports {
+		report = append(report, found[i.Package])
+	}
+	return report, nil
+}
+
+// latestVersions picks the latest of tags with the same major and minor
+// version as current, with the same major version, and overall. Only the
+// last one can be found when current isn't a semantic version. Pre-releases
+// are left out.
+func latestVersions(current string, tags []*semver.Version) (patch, minor, major string) {
+	cur, err := semver.NewVersion(current)
+	if err != nil {
+		cur = nil
+	}
+	for _, v := range tags {
+		if v.Prerelease() != "" {
+			continue
+		}
+		major = v.Original()
+		if cur == nil || v.Major() != cur.Major() {
+			continue
+		}
+		minor = v.Original()
+		if v.Minor() == cur.Minor() {
+			patch = v.Original()
+		}
+	}
+	return patch, minor, major
+}
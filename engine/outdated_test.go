@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/Masterminds/semver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestVersions(t *testing.T) {
+	assert := require.New(t)
+
+	var tags []*semver.Version
+	for _, tag := range []string{"v1.2.0", "v1.2.3", "v1.3.0", "v1.4.1", "v2.0.0", "v2.1.0", "v3.0.0-rc1"} {
+		v, err := semver.NewVersion(tag)
+		assert.NoError(err)
+		tags = append(tags, v)
+	}
+
+	for _, c := range []struct {
+		current, patch, minor, major string
+	}{
+		{"v1.2.0", "v1.2.3", "v1.4.1", "v2.1.0"},
+		{"v2.0.0", "v2.0.0", "v2.1.0", "v2.1.0"},
+		{"v0.9.0", "", "", "v2.1.0"},
+		{"master", "", "", "v2.1.0"},
+	} {
+		patch, minor, major := latestVersions(c.current, tags)
+		assert.Equal(c.patch, patch, c.current)
+		assert.Equal(c.minor, minor, c.current)
+		assert.Equal(c.major, major, c.current)
+	}
+}
@@ -0,0 +1,369 @@
+package engine
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/Masterminds/semver"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultProxy is where imports with the proxy vcs option come from when
+// there's neither a proxy in the options nor a repo URL.
+const defaultProxy = "https://proxy.golang.org"
+
+// proxyMarker is the file which marks the dir of an import as the module of a
+// proxy. It holds the URL of the module.
+const proxyMarker = ".trash-proxy"
+
+// proxyRepo is the module of an import in a module proxy, which speaks the
+// GOPROXY protocol over https:// or file://. Its versions stand for both
+// commits and tags: the list, .info and .zip files are downloaded to the
+// cache once, and the zips are what's exported. The dir of the import only
+// has the URL of the module in it.
+type proxyRepo struct {
+	c   *cache
+	dir string
+	i   conf.Import
+}
+
+func newProxyRepo(c *cache, dir string, i conf.Import) repo {
+	return &proxyRepo{c: c, dir: dir, i: i}
+}
+
+// isProxyDir tells whether dir is the dir of a module from a proxy.
+func isProxyDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, proxyMarker))
+	return err == nil
+}
+
+// proxy returns the URL of the proxy the import comes from: its repo URL,
+// or else the proxy in the options.
+func (r *proxyRepo) proxy() string {
+	if r.i.Repo != "" {
+		return strings.TrimSuffix(r.i.Repo, "/")
+	}
+	if r.c.proxy != "" {
+		return strings.TrimSuffix(r.c.proxy, "/")
+	}
+	return defaultProxy
+}
+
+func (r *proxyRepo) moduleURL() string {
+	return r.proxy() + "/" + escapePath(r.i.Package)
+}
+
+// downloads is where the files of the module are kept in the cache, laid out
+// like a proxy of its own.
+func (r *proxyRepo) downloads() string {
+	return filepath.Join(r.c.dir, "proxy", filepath.FromSlash(storeKey(r.moduleURL())), "@v")
+}
+
+// prepare finds the module of the import, which is the closest dir up from
+// its package the proxy has versions of, and marks its dir.
+func (r *proxyRepo) prepare() error {
+	if isProxyDir(r.dir) {
+		if url, err := r.remoteURL(); err == nil && url == r.moduleURL() {
+			return nil
+		}
+	}
+	if r.c.offline {
+		return notCachedError(fmt.Sprintf("the module of '%s' from '%s'", r.i.Package, r.proxy()))
+	}
+	logrus.Infof("Looking up the module of '%s' in '%s'", r.i.Package, r.proxy())
+	r.c.events.OnEvent(Event{Kind: EventClone, Package: r.i.Package})
+	found := false
+	for mod := r.i.Package; mod != "." && mod != "/"; mod = path.Dir(mod) {
+		list, err := get(r.proxy() + "/" + escapePath(mod) + "/@v/list")
+		if _, ok := err.(notFoundError); ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if mod != r.i.Package {
+			// the import is a package inside the module
+			r.i.Package, r.dir = mod, r.c.cloneDir(mod)
+		}
+		if err := r.save("list", list); err != nil {
+			return err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return fmt.Errorf("no module of '%s' in '%s'", r.i.Package, r.proxy())
+	}
+
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(r.dir, proxyMarker), []byte(r.moduleURL()+"\n"), 0644)
+}
+
+// fetch downloads the list of the versions of the module again.
+func (r *proxyRepo) fetch() error {
+	list, err := get(r.moduleURL() + "/@v/list")
+	if err != nil {
+		return err
+	}
+	return r.save("list", list)
+}
+
+// branch returns name: modules have no branches, but proxies may resolve
+// queries like "master" to a version, and the default branch is the latest
+// version.
+func (r *proxyRepo) branch(name string) (string, bool) {
+	return name, false
+}
+
+func (r *proxyRepo) export(ref, dest string) error {
+	file := escapePath(ref) + ".zip"
+	data, err := r.download(file, true)
+	if err != nil {
+		return err
+	}
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("bad zip of '%s@%s': %v", r.i.Package, ref, err)
+	}
+	prefix := r.i.Package + "@" + ref + "/"
+	for _, f := range z.File {
+		if !strings.HasPrefix(f.Name, prefix) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(f.Name, prefix))
+		if name == "." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return fmt.Errorf("bad file '%s' in the zip of '%s@%s'", f.Name, r.i.Package, ref)
+		}
+		if err := unzipFile(f, filepath.Join(dest, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unzipFile(f *zip.File, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, f.Modified, f.Modified)
+}
+
+// latest returns the version the proxy says is the latest, or else the
+// highest one in the list.
+func (r *proxyRepo) latest() (string, error) {
+	if !r.c.offline {
+		if data, err := get(r.moduleURL() + "/@latest"); err == nil {
+			var info proxyInfo
+			if err := json.Unmarshal(data, &info); err == nil && info.Version != "" {
+				return info.Version, nil
+			}
+		}
+	}
+	tags, err := r.tags()
+	if err != nil {
+		return "", err
+	}
+	var versions []*semver.Version
+	for _, tag := range tags {
+		if v, err := semver.NewVersion(tag); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		return "", fmt.Errorf("no versions of '%s' in '%s'", r.i.Package, r.proxy())
+	}
+	sort.Sort(semver.Collection(versions))
+	return versions[len(versions)-1].Original(), nil
+}
+
+func (r *proxyRepo) tags() ([]string, error) {
+	data, err := r.download("list", false)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+// proxyInfo is the .info file of a version.
+type proxyInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// revision returns the version of ref, which is a version or a query the
+// proxy resolves, like a branch. The .info files of versions are kept.
+func (r *proxyRepo) revision(ref string) (revision, error) {
+	if ref == defaultBranch {
+		latest, err := r.latest()
+		if err != nil {
+			return revision{}, err
+		}
+		ref = latest
+	}
+	file := escapePath(ref) + ".info"
+	data, err := r.download(file, isVersion(ref))
+	if err != nil {
+		return revision{}, err
+	}
+	var info proxyInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return revision{}, fmt.Errorf("bad info of '%s@%s': %v", r.i.Package, ref, err)
+	}
+	if info.Version == "" {
+		return revision{}, fmt.Errorf("no version in the info of '%s@%s'", r.i.Package, ref)
+	}
+	if info.Version != ref {
+		if err := r.save(escapePath(info.Version)+".info", data); err != nil {
+			return revision{}, err
+		}
+	}
+	return revision{Commit: info.Version, Time: info.Time.UTC()}, nil
+}
+
+func (r *proxyRepo) remoteURL() (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, proxyMarker))
+	if err != nil {
+		return "", fmt.Errorf("no module URL in '%s': %v", r.dir, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (r *proxyRepo) behind(commit, ref string) (int, error) {
+	return 0, fmt.Errorf("can't count the commits of modules from a proxy")
+}
+
+// download returns the file of the module called name, from the cache if
+// keep and it's there, from the proxy otherwise. Offline, it's always from
+// the cache.
+func (r *proxyRepo) download(name string, keep bool) ([]byte, error) {
+	cached := filepath.Join(r.downloads(), name)
+	if keep || r.c.offline {
+		data, err := ioutil.ReadFile(cached)
+		if err == nil {
+			return data, nil
+		}
+		if r.c.offline {
+			return nil, notCachedError(fmt.Sprintf("'%s' of '%s'", name, r.i.Package))
+		}
+	}
+	data, err := get(r.moduleURL() + "/@v/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.save(name, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// save writes the file of the module called name to the cache.
+func (r *proxyRepo) save(name string, data []byte) error {
+	file := filepath.Join(r.downloads(), name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// notFoundError is a file a proxy doesn't have.
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("'%s' not found", string(e))
+}
+
+// get returns the file at url, which is https://, http:// or file://.
+func get(url string) ([]byte, error) {
+	logrus.Debugf("Getting '%s'", url)
+	if strings.HasPrefix(url, "file://") {
+		data, err := ioutil.ReadFile(filepath.FromSlash(strings.TrimPrefix(url, "file://")))
+		if os.IsNotExist(err) {
+			return nil, notFoundError(url)
+		}
+		return data, err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, notFoundError(url)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("getting '%s': %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// isVersion tells whether v is a canonical semantic version, which names the
+// same files forever, rather than a query.
+func isVersion(v string) bool {
+	sv, err := semver.NewVersion(v)
+	return err == nil && "v"+sv.String() == v
+}
+
+// escapePath escapes the upper case letters of a module path or a version as
+// the GOPROXY protocol wants: "!" and the letter in lower case.
+func escapePath(p string) string {
+	var b strings.Builder
+	for _, c := range p {
+		if 'A' <= c && c <= 'Z' {
+			b.WriteByte('!')
+			c += 'a' - 'A'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// writeModule adds version of mod, with files, to the file proxy in dir.
+func writeModule(t *testing.T, dir, mod, version string, files map[string]string) {
+	assert := require.New(t)
+	v := filepath.Join(dir, filepath.FromSlash(escapePath(mod)), "@v")
+	assert.NoError(os.MkdirAll(v, 0755))
+
+	list, err := os.OpenFile(filepath.Join(v, "list"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(err)
+	fmt.Fprintln(list, version)
+	assert.NoError(list.Close())
+	info := fmt.Sprintf(`{"Version":"%s","Time":"2019-01-02T03:04:05Z"}`, version)
+	assert.NoError(ioutil.WriteFile(filepath.Join(v, version+".info"), []byte(info), 0644))
+
+	out, err := os.Create(filepath.Join(v, version+".zip"))
+	assert.NoError(err)
+	z := zip.NewWriter(out)
+	for name, content := range files {
+		w, err := z.Create(mod + "@" + version + "/" + name)
+		assert.NoError(err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(err)
+	}
+	assert.NoError(z.Close())
+	assert.NoError(out.Close())
+}
+
+func TestProxyRepo(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-proxy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	proxyDir := filepath.Join(dir, "proxy")
+	writeModule(t, proxyDir, "example.com/Foo", "v1.0.0", map[string]string{"a.go": "package foo\n", "sub/b.go": "package sub\n"})
+	writeModule(t, proxyDir, "example.com/Foo", "v1.1.0", map[string]string{"a.go": "package foo // v1.1.0\n", "sub/b.go": "package sub\n"})
+	server := httptest.NewServer(http.FileServer(http.Dir(proxyDir)))
+	defer server.Close()
+
+	for _, proxy := range []string{"file://" + proxyDir, server.URL} {
+		c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), proxy: proxy, events: nopListener{}}
+		assert.NoError(os.MkdirAll(c.work, 0755))
+
+		// the module of a package inside it is looked up
+		i := conf.Import{Package: "example.com/Foo/sub", Version: "v1.0.0"}
+		assert.NoError(c.prepare(i), proxy)
+		assert.NoError(c.checkout(i))
+		bytes, err := ioutil.ReadFile(filepath.Join(c.repoDir("example.com/Foo"), "a.go"))
+		assert.NoError(err)
+		assert.Equal("package foo\n", string(bytes))
+		assert.FileExists(filepath.Join(c.repoDir(i.Package), "b.go"))
+
+		rev, err := c.revision(i, "HEAD")
+		assert.NoError(err)
+		assert.Equal("v1.0.0", rev.Commit)
+		remote, err := c.remote(i)
+		assert.NoError(err)
+		assert.Equal(proxy+"/example.com/!foo", remote)
+
+		i = conf.Import{Package: "example.com/Foo", Version: "^1.0"}
+		tag, err := c.resolveTag(i)
+		assert.NoError(err)
+		assert.Equal("v1.1.0", tag)
+		latest, err := c.latestVersion(i)
+		assert.NoError(err)
+		assert.Equal("v1.1.0", latest)
+		version, err := moduleVersion(i, revision{Commit: "v1.1.0"})
+		assert.NoError(err)
+		assert.Equal("v1.1.0", version)
+
+		assert.NoError(os.RemoveAll(c.work))
+	}
+
+	// what's been downloaded is there offline
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), proxy: server.URL, offline: true, events: nopListener{}}
+	assert.NoError(os.MkdirAll(c.work, 0755))
+	server.Close()
+	i := conf.Import{Package: "example.com/Foo", Version: "v1.0.0"}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	err = c.checkout(conf.Import{Package: "example.com/Foo", Version: "v1.2.0"})
+	assert.IsType(&PackageError{}, err)
+	assert.IsType(notCachedError(""), err.(*PackageError).Err)
+}
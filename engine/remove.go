@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Remove takes the imports of pkgs out of the conf file and the target dir.
+func Remove(opts Options, pkgs []string) error {
+	p, err := loadProject(opts, false)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	trashConf := p.trashConf
+
+	removed := map[string]bool{}
+	for _, pkg := range pkgs {
+		if err := trashConf.Remove(pkg); err != nil {
+			return err
+		}
+		removed[pkg] = true
+	}
+
+	return p.stage(func() error {
+		if err := p.dumpConf(trashConf); err != nil {
+			return err
+		}
+		for pkg := range removed {
+			logrus.Infof("Removing '%s'", pkg)
+			if err := removeImportDir(p.opts.TargetDir, pkg, nestedImports(pkg, trashConf.Imports), p.opts.Events); err != nil {
+				return err
+			}
+		}
+		return p.relock(removed, map[string]revision{})
+	})
+}
+
+// removeImportDir removes the dir of pkg from vendorDir, except for the dirs
+// which belong to other imports, and then its parents if that left them empty.
+func removeImportDir(vendorDir, pkg string, nested func(rel string) bool, events Listener) error {
+	pkgDir := filepath.Join(vendorDir, filepath.FromSlash(pkg))
+	if err := filepath.Walk(pkgDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(pkgDir, path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case path == pkgDir:
+			return nil
+		case info.IsDir() && nested(filepath.ToSlash(rel)):
+			return filepath.SkipDir
+		case info.IsDir():
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		events.OnEvent(Event{Kind: EventRemove, Package: pkg, Path: path})
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := removeEmptyDirs(pkgDir); err != nil {
+		return err
+	}
+	for d := pkgDir; d != vendorDir && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if err := os.Remove(d); err != nil {
+			break // not empty, or already gone
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rdeusser/trash/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stage runs f on a copy of the target dir, made next to it, with the lock,
+// go.mod and the conf file written next to the copy too. Only if f succeeds
+// does the copy take the place of the target dir, and the files theirs: when
+// it fails, or the operation is canceled before the swap, everything is left
+// as it was.
+func (p *project) stage(f func() error) error {
+	opts := p.opts
+	target := opts.TargetDir
+	if real, err := filepath.EvalSymlinks(target); err == nil {
+		target = real
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(target), "."+filepath.Base(target)+".")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	files, err := ioutil.TempDir(staging, "files")
+	if err != nil {
+		return err
+	}
+
+	p.opts.TargetDir = filepath.Join(staging, filepath.Base(target))
+	p.opts.otherTargets = append(opts.otherTargets, opts.TargetDir)
+	p.opts.OutLockFile = filepath.Join(files, LockFile)
+	p.opts.OutModFile = filepath.Join(files, "go.mod")
+	staged := [][2]string{
+		{p.opts.TargetDir, target},
+		{p.opts.OutLockFile, opts.OutLockFile},
+		{p.opts.OutModFile, opts.OutModFile},
+	}
+	if p.trashConf != nil {
+		if confFile := p.trashConf.ConfFile(); confFile == opts.OutModFile {
+			p.opts.outConfFile = p.opts.OutModFile
+		} else {
+			if err := os.Mkdir(filepath.Join(files, "conf"), 0755); err != nil {
+				return err
+			}
+			p.opts.outConfFile = filepath.Join(files, "conf", filepath.Base(confFile))
+			staged = append(staged, [2]string{p.opts.outConfFile, confFile})
+		}
+	}
+	paths := map[string]string{}
+	for _, f := range staged {
+		paths[f[0]] = f[1]
+	}
+	paths[p.opts.TargetDir] = opts.TargetDir
+	p.opts.Events = stagedListener{opts.Events, paths}
+	defer func() { p.opts = opts }()
+
+	if _, err := os.Stat(target); err == nil {
+		// hardlinks: files in the copy get replaced, never written to
+		if err := util.CopyTree(target, p.opts.TargetDir, util.Hardlink); err != nil {
+			return err
+		}
+	}
+	if err := f(); err != nil {
+		return err
+	}
+	if err := p.opts.canceled(); err != nil {
+		return err
+	}
+
+	return swap(staging, staged...)
+}
+
+// exchange swaps two files or dirs in one step, where that can be done.
+var exchange = util.Exchange
+
+// swap moves each staged file or dir, the first of a pair, to where it goes,
+// the second, skipping those which weren't written. If one of them can't be
+// moved, the ones moved before are put back, along with what was in their
+// place: either all of them are moved, or none.
+//
+// Where exchange works (Linux), each one takes the place of the old one in
+// one step, so there's always one of them there. Elsewhere, the old one is
+// moved aside, into a dir in staging, before the staged one is moved in:
+// for that moment, there's none.
+func swap(staging string, files ...[2]string) (err error) {
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for k := len(undo) - 1; k >= 0; k-- {
+			if err := undo[k](); err != nil {
+				logrus.Errorf("Could not put everything back as it was: %v", err)
+			}
+		}
+	}()
+
+	previous := ""
+	for _, f := range files {
+		staged, dest := f[0], f[1]
+		if _, err := os.Lstat(staged); os.IsNotExist(err) {
+			continue
+		}
+		if _, err := os.Lstat(dest); os.IsNotExist(err) {
+			if err := os.Rename(staged, dest); err != nil {
+				return err
+			}
+			undo = append(undo, func() error { return os.Rename(dest, staged) })
+			continue
+		}
+		err := exchange(staged, dest)
+		if err == nil {
+			undo = append(undo, func() error { return exchange(staged, dest) })
+			continue
+		}
+		logrus.Debugf("Could not exchange '%s' and '%s', moving the old one aside: %v", staged, dest, err)
+		if previous == "" {
+			if previous, err = ioutil.TempDir(staging, "previous"); err != nil {
+				return err
+			}
+		}
+		old := filepath.Join(previous, fmt.Sprint(len(undo)))
+		if err := os.Rename(dest, old); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return os.Rename(old, dest) })
+		if err := os.Rename(staged, dest); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return os.Rename(dest, staged) })
+	}
+	return nil
+}
+
+// stagedListener passes the events on with the paths of the staged files
+// turned into the paths they are moved to.
+type stagedListener struct {
+	Listener
+	paths map[string]string
+}
+
+func (l stagedListener) OnEvent(e Event) {
+	for staged, p := range l.paths {
+		if e.Path == staged || strings.HasPrefix(e.Path, staged+string(filepath.Separator)) {
+			e.Path = p + e.Path[len(staged):]
+			break
+		}
+	}
+	l.Listener.OnEvent(e)
+}
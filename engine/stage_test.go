@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStage(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-stage")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "vendor")
+	assert.NoError(os.MkdirAll(filepath.Join(target, "example.com", "a"), 0755))
+	old := filepath.Join(target, "example.com", "a", "a.go")
+	assert.NoError(ioutil.WriteFile(old, []byte("package a\n"), 0644))
+
+	confFile := filepath.Join(dir, "vendor.conf")
+	assert.NoError(ioutil.WriteFile(confFile, []byte("example.com/proj\n\nexample.com/a v1.0.0\n"), 0644))
+	trashConf, err := conf.Parse(confFile)
+	assert.NoError(err)
+	read := func(file string) string {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		return string(data)
+	}
+
+	var paths []string
+	p := &project{
+		opts: Options{
+			TargetDir:   target,
+			OutLockFile: filepath.Join(dir, LockFile),
+			OutModFile:  filepath.Join(dir, "go.mod"),
+			Events: ListenerFunc(func(e Event) {
+				paths = append(paths, e.Path)
+			}),
+		},
+		cache:     &cache{work: filepath.Join(dir, "work")},
+		lock:      &conf.Lock{},
+		trashConf: trashConf,
+	}
+	change := func() error {
+		vendorDir := p.opts.TargetDir
+		assert.NotEqual(target, vendorDir)
+		assert.FileExists(filepath.Join(vendorDir, "example.com", "a", "a.go"))
+		if err := os.RemoveAll(filepath.Join(vendorDir, "example.com", "a")); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(vendorDir, "example.com", "b"), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(vendorDir, "example.com", "b", "b.go"), []byte("package b\n"), 0644); err != nil {
+			return err
+		}
+		p.opts.Events.OnEvent(Event{Kind: EventCopy, Path: filepath.Join(vendorDir, "example.com", "b")})
+		if err := p.trashConf.SetVersion(p.outConfFile(), "example.com/a", "v1.1.0", ""); err != nil {
+			return err
+		}
+		p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: p.outConfFile()})
+		return p.dumpLock(p.lock)
+	}
+
+	// a failure leaves everything as it was
+	assert.Error(p.stage(func() error {
+		if err := change(); err != nil {
+			return err
+		}
+		return errors.New("failed")
+	}))
+	assert.Equal(target, p.opts.TargetDir)
+	assert.FileExists(old)
+	assert.Equal("example.com/proj\n\nexample.com/a v1.0.0\n", read(confFile))
+	for _, p := range []string{filepath.Join(target, "example.com", "b"), filepath.Join(dir, LockFile)} {
+		_, err = os.Stat(p)
+		assert.True(os.IsNotExist(err), p)
+	}
+
+	// and so does a cancel, even once f is done
+	cancel := make(chan struct{})
+	p.opts.Cancel = cancel
+	assert.Equal(ErrInterrupted, p.stage(func() error {
+		close(cancel)
+		return change()
+	}))
+	assert.FileExists(old)
+	assert.Equal("example.com/proj\n\nexample.com/a v1.0.0\n", read(confFile))
+	_, err = os.Stat(filepath.Join(dir, LockFile))
+	assert.True(os.IsNotExist(err))
+	p.opts.Cancel = nil
+
+	assert.NoError(p.stage(change))
+	assert.FileExists(filepath.Join(target, "example.com", "b", "b.go"))
+	assert.FileExists(filepath.Join(dir, LockFile))
+	for _, p := range []string{old, filepath.Join(dir, "go.mod")} {
+		_, err = os.Stat(p)
+		assert.True(os.IsNotExist(err), p)
+	}
+	assert.Contains(paths, filepath.Join(target, "example.com", "b"))
+	assert.Contains(paths, filepath.Join(dir, LockFile))
+	assert.Contains(paths, confFile)
+	assert.Equal("example.com/proj\n\nexample.com/a v1.1.0\n", read(confFile))
+
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch([]string{"vendor", LockFile, "vendor.conf"}, names, "staging dirs are removed")
+}
+
+func TestSwap(t *testing.T) {
+	defer func(e func(a, b string) error) { exchange = e }(exchange)
+	for name, e := range map[string]func(a, b string) error{
+		"exchange": exchange,
+		"aside":    func(a, b string) error { return errors.New("no exchange") },
+	} {
+		exchange = e
+		t.Run(name, testSwap)
+	}
+}
+
+func testSwap(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-swap")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	staging := filepath.Join(dir, ".staging")
+	write := func(file, content string) {
+		assert.NoError(os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+	}
+	read := func(file string) string {
+		data, err := ioutil.ReadFile(file)
+		assert.NoError(err)
+		return string(data)
+	}
+	write(filepath.Join(dir, "vendor", "a.go"), "old")
+	write(filepath.Join(dir, LockFile), "old")
+	write(filepath.Join(staging, "vendor", "a.go"), "new")
+	write(filepath.Join(staging, LockFile), "new")
+	write(filepath.Join(staging, "go.mod"), "new")
+	write(filepath.Join(staging, "conf"), "new")
+	files := [][2]string{
+		{filepath.Join(staging, "vendor"), filepath.Join(dir, "vendor")},
+		{filepath.Join(staging, LockFile), filepath.Join(dir, LockFile)},
+		{filepath.Join(staging, "go.mod"), filepath.Join(dir, "go.mod")},
+		{filepath.Join(staging, "modules.txt"), filepath.Join(dir, "modules.txt")},
+	}
+
+	// a file which can't be moved puts back the ones moved before it
+	assert.Error(swap(staging, append(files[:3:3], [2]string{filepath.Join(staging, "conf"), filepath.Join(dir, "missing", "conf")})...))
+	assert.Equal("old", read(filepath.Join(dir, "vendor", "a.go")))
+	assert.Equal("old", read(filepath.Join(dir, LockFile)))
+	assert.Equal("new", read(filepath.Join(staging, "vendor", "a.go")))
+	assert.Equal("new", read(filepath.Join(staging, LockFile)))
+	assert.Equal("new", read(filepath.Join(staging, "go.mod")))
+	_, err = os.Stat(filepath.Join(dir, "go.mod"))
+	assert.True(os.IsNotExist(err))
+
+	assert.NoError(swap(staging, files...))
+	assert.Equal("new", read(filepath.Join(dir, "vendor", "a.go")))
+	assert.Equal("new", read(filepath.Join(dir, LockFile)))
+	assert.Equal("new", read(filepath.Join(dir, "go.mod")))
+	_, err = os.Stat(filepath.Join(dir, "modules.txt"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,1398 @@
+package engine
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/util"
+
+	"github.com/Masterminds/glide/godep"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LockFile is the name of the lock file, in the project dir.
+const LockFile = "trash.lock"
+
+// Options are the settings of an operation. Relative paths are relative to
+// Dir, and zero values get the defaults of the trash command.
+type Options struct {
+	Dir           string          // the project dir, "." by default
+	ConfFile      string          // "vendor.conf" by default, or the first known conf file found
+	TargetDir     string          // "vendor" by default
+	CacheDir      string          // "$HOME/.trash-cache" by default
+	MirrorsFile   string          // the mirrors to fetch repos from, "$HOME/.trash-mirrors.yaml" by default
+	OutLockFile   string          // where to write the lock, which is always read from Dir
+	OutModFile    string          // where to write go.mod with Modules
+	Keep          bool            // keep all checked out files
+	Insecure      bool            // look up import paths over http when https fails
+	IncludeVendor bool            // with Keep, keep the vendor dirs of the imports too
+	Modules       bool            // write go.mod and modules.txt, for `go build -mod=vendor`
+	Jobs          int             // how many repos to fetch and check out at the same time, 8 by default
+	CopyMode      util.CopyMode   // how files are copied from the cache: copied, hardlinked or reflinked
+	Offline       bool            // get everything from the cache, failing if it isn't there
+	Proxy         string          // the GOPROXY to get the modules of the imports without a repo URL or vcs option from
+	GOPATH        string          // to guess the root package when the conf file doesn't name it
+	Events        Listener        // gets the progress of the operation
+	Cancel        <-chan struct{} // closed to stop the operation, which then fails with ErrInterrupted
+
+	// otherTargets are target dirs in Dir other than TargetDir, like the
+	// one a staged or scratch target dir takes the place of, which are no
+	// packages of the project
+	otherTargets []string
+	// outConfFile is where the conf file is written, when it's not where
+	// it was read from
+	outConfFile string
+}
+
+// canceled returns ErrInterrupted once Cancel is closed. The operations check
+// it between imports, and before they change anything outside of staging.
+func (o Options) canceled() error {
+	select {
+	case <-o.Cancel:
+		return ErrInterrupted
+	default:
+		return nil
+	}
+}
+
+func (o Options) resolve() (Options, error) {
+	if o.Dir == "" {
+		o.Dir = "."
+	}
+	dir, err := filepath.Abs(o.Dir)
+	if err != nil {
+		return o, err
+	}
+	o.Dir = dir
+	if o.ConfFile == "" {
+		o.ConfFile = "vendor.conf"
+	}
+	if o.TargetDir == "" {
+		o.TargetDir = "vendor"
+	}
+	o.TargetDir = inDir(dir, o.TargetDir)
+	if o.CacheDir == "" {
+		o.CacheDir = path.Join(os.Getenv("HOME"), ".trash-cache")
+	}
+	if o.CacheDir, err = filepath.Abs(o.CacheDir); err != nil {
+		return o, err
+	}
+	if o.MirrorsFile == "" {
+		o.MirrorsFile = path.Join(os.Getenv("HOME"), ".trash-mirrors.yaml")
+	}
+	if o.OutLockFile == "" {
+		o.OutLockFile = LockFile
+	}
+	o.OutLockFile = inDir(dir, o.OutLockFile)
+	if o.OutModFile == "" {
+		o.OutModFile = "go.mod"
+	}
+	o.OutModFile = inDir(dir, o.OutModFile)
+	if o.Jobs == 0 {
+		o.Jobs = 8
+	}
+	if o.Events == nil {
+		o.Events = nopListener{}
+	}
+	return o, nil
+}
+
+// project is what the operations work on: the resolved options, the conf
+// file and the lock, which is empty if there is none.
+type project struct {
+	opts      Options
+	cache     *cache
+	trashConf *conf.Conf
+	lock      *conf.Lock
+}
+
+// loadProject reads the conf file and the lock of opts.Dir. With create, a
+// missing conf file gets created.
+func loadProject(opts Options, create bool) (*project, error) {
+	opts, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("dir: '%s'", opts.Dir)
+
+	trashConf, err := loadConf(opts.Dir, opts.ConfFile, create)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := conf.ParseLock(filepath.Join(opts.Dir, LockFile))
+	if os.IsNotExist(err) {
+		lock = &conf.Lock{Package: trashConf.Package, Excludes: trashConf.Excludes}
+	} else if err != nil {
+		return nil, err
+	}
+
+	mirrors, err := loadMirrors(opts.MirrorsFile)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openCache(opts, mirrors)
+	if err != nil {
+		return nil, err
+	}
+	return &project{
+		opts:      opts,
+		cache:     c,
+		trashConf: trashConf,
+		lock:      lock,
+	}, nil
+}
+
+// openCache opens the cache of opts, with a work dir of its own for the run,
+// which close removes.
+func openCache(opts Options, mirrors *mirrorRules) (*cache, error) {
+	if err := os.MkdirAll(filepath.Join(opts.CacheDir, "src"), 0755); err != nil {
+		return nil, err
+	}
+	work, err := ioutil.TempDir(opts.CacheDir, "work")
+	if err != nil {
+		return nil, err
+	}
+	return &cache{dir: opts.CacheDir, work: work, insecure: opts.Insecure, offline: opts.Offline, mirrors: mirrors, proxy: opts.Proxy, events: opts.Events, cancel: opts.Cancel}, nil
+}
+
+// close removes what the project checked out in the cache.
+func (p *project) close() {
+	if err := p.cache.close(); err != nil {
+		logrus.Warnf("Could not clean up the cache: %v", err)
+	}
+}
+
+// targetDirs are the dirs in the project dir which vendoring writes to,
+// rather than packages of the project.
+func (p *project) targetDirs() []string {
+	return append([]string{p.opts.TargetDir}, p.opts.otherTargets...)
+}
+
+// outConfFile is where the conf file is written: where stage put it, or else
+// where it was read from.
+func (p *project) outConfFile() string {
+	if p.opts.outConfFile != "" {
+		return p.opts.outConfFile
+	}
+	return p.trashConf.ConfFile()
+}
+
+// rootPackage is the import path of the project.
+func (p *project) rootPackage() (string, error) {
+	if p.trashConf.Package != "" {
+		return p.trashConf.Package, nil
+	}
+	return guessRootPackage(p.opts.Dir, p.opts.GOPATH)
+}
+
+// Vendor checks out the imports in the conf file, at the commits in the lock
+// as long as their versions haven't changed, and copies them to the target
+// dir. Then it removes what the project doesn't need and writes the lock.
+func Vendor(opts Options) error {
+	return trash(opts, false)
+}
+
+// Update is like Vendor, but it collects the imports of the project again and
+// writes them to the conf file at their latest versions, ignoring the lock.
+func Update(opts Options) error {
+	return trash(opts, true)
+}
+
+// Cleanup removes what the project doesn't need from the target dir, like
+// Vendor does after copying the imports, and writes the lock for what's left.
+// Nothing is checked out: the revisions come from the lock.
+func Cleanup(opts Options) error {
+	p, err := loadProject(opts, false)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	revisions := map[string]revision{}
+	if p.opts.Modules {
+		// pseudo-versions need the time of the commits, from the cache
+		if err := p.lockedRevisions(revisions); err != nil {
+			return err
+		}
+	} else {
+		for _, l := range p.lock.Imports {
+			revisions[l.Package] = revision{Commit: l.Commit, Remote: l.Remote, Tag: l.Tag}
+		}
+	}
+	return p.stage(func() error {
+		if err := p.cleanup(revisions); err != nil {
+			return err
+		}
+		if p.opts.Modules {
+			return p.writeModules(revisions)
+		}
+		return nil
+	})
+}
+
+func trash(opts Options, update bool) error {
+	p, err := loadProject(opts, update)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	return p.stage(func() error {
+		return p.run(update)
+	})
+}
+
+// run vendors the imports, updating them first with update.
+func (p *project) run(update bool) error {
+	trashConf, lock := p.trashConf, p.lock
+	keep, vendorDir := p.opts.Keep, p.opts.TargetDir
+
+	if !update && len(lock.Imports) > 0 {
+		logrus.Infof("Trash! Using commits from '%s'", LockFile)
+		lock.Pin(trashConf)
+	}
+
+	if update {
+		if err := p.updateTrash(trashConf); err != nil {
+			return err
+		}
+	}
+
+	alreadyImported := map[string]bool{}
+	extraImports, err := p.updateTransitiveVendor(update, trashConf, alreadyImported)
+	if err != nil {
+		return err
+	}
+
+	// clean duplicate imports
+	importMap := map[string]conf.Import{}
+	for _, i := range extraImports {
+		importMap[i.Package] = i
+	}
+	extraImports = []conf.Import{}
+	for _, i := range importMap {
+		extraImports = append(extraImports, i)
+	}
+
+	var filteredExtraImports []conf.Import
+	for _, extraImport := range extraImports {
+		packageAlreadyImported := false
+		for _, packageImport := range trashConf.Imports {
+			if packageImport.Package == extraImport.Package {
+				packageAlreadyImported = true
+				break
+			}
+		}
+		if !packageAlreadyImported {
+			filteredExtraImports = append(filteredExtraImports, extraImport)
+		}
+	}
+	trashConf.Imports = append(trashConf.Imports, filteredExtraImports...)
+	if !update {
+		lock.Pin(trashConf)
+	}
+
+	revisions, unchanged, err := p.vendor(trashConf, update)
+	if err != nil {
+		return err
+	}
+
+	if !update {
+		for _, packageImport := range trashConf.Imports {
+			if !packageImport.Staging {
+				continue
+			}
+
+			packageLocation := path.Dir(packageImport.Package)
+			baseDir := path.Join(p.cache.repoDir(packageImport.Package), "staging/src", packageLocation)
+
+			files, err := ioutil.ReadDir(baseDir)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				repoDir := path.Join(baseDir, f.Name())
+				target := path.Join(vendorDir, packageLocation, f.Name())
+				if err := util.CopyTree(repoDir, target, p.opts.CopyMode); err != nil {
+					return fmt.Errorf("could not copy '%s' to '%s': %v", repoDir, target, err)
+				}
+			}
+		}
+	}
+
+	if keep {
+		if !p.opts.IncludeVendor {
+			root := vendorDir
+			return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return filepath.SkipDir
+				}
+				if info.IsDir() && info.Name() == "vendor" && path != root {
+					logrus.Infof("Removing %s", path)
+					os.RemoveAll(path)
+					p.opts.Events.OnEvent(Event{Kind: EventRemove, Path: path})
+					return filepath.SkipDir
+				}
+				return nil
+			})
+		}
+		return nil
+	}
+	if err := p.copyPruned(trashConf, unchanged, revisions); err != nil {
+		return err
+	}
+	if err := p.cleanup(revisions); err != nil {
+		return err
+	}
+	if p.opts.Modules {
+		return p.writeModules(revisions)
+	}
+	return nil
+}
+
+// loadConf reads confFile, or the first of the other known conf files that
+// exists in dir. With create, a missing confFile gets created.
+func loadConf(dir, confFile string, create bool) (*conf.Conf, error) {
+	var err error
+	for _, f := range []string{confFile, "trash.conf", "vndr.cfg", "vendor.manifest", "trash.yml", "glide.yaml", "glide.yml", "trash.yaml", "Gopkg.toml", "Gopkg.lock", "go.mod"} {
+		if _, err = os.Stat(inDir(dir, f)); err == nil {
+			confFile = f
+			break
+		}
+	}
+	confPath := inDir(dir, confFile)
+	if err != nil {
+		if os.IsNotExist(err) && create {
+			logrus.Warnf("Trash! '%s' not found, creating a new one!", confFile)
+			if _, err = os.Create(confPath); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+	logrus.Infof("Trash! Reading file: '%s'", confFile)
+
+	return conf.Parse(confPath)
+}
+
+func (p *project) updateTransitiveVendor(update bool, trashConf *conf.Conf, alreadyImported map[string]bool) ([]conf.Import, error) {
+	extraImports := []conf.Import{}
+	// we don't need to vendor files first if none of the imports are transitive
+	updateVendor := false
+	for _, packageImport := range trashConf.Imports {
+		if packageImport.Transitive {
+			updateVendor = true
+			break
+		}
+	}
+	if updateVendor {
+		if _, _, err := p.vendor(trashConf, update); err != nil {
+			return extraImports, err
+		}
+	}
+	for _, packageImport := range trashConf.Imports {
+		if packageImport.Transitive {
+			if alreadyImported[packageImport.Package] {
+				logrus.Warnf("Already searched transitive dep %s. Skipping", packageImport.Package)
+				continue
+			}
+			alreadyImported[packageImport.Package] = true
+			if update && packageImport.Lock {
+				continue
+			}
+			imports, config, err := transitiveImports(p.cache.repoDir(packageImport.Package))
+			if err != nil {
+				return extraImports, err
+			}
+			if config != nil {
+				nested, err := p.updateTransitiveVendor(update, config, alreadyImported)
+				if err != nil {
+					return extraImports, err
+				}
+				extraImports = append(extraImports, nested...)
+			}
+			extraImports = append(extraImports, imports...)
+		}
+	}
+	return extraImports, nil
+}
+
+// transitiveImports reads the dependencies of the repo checked out in repoDir,
+// from its Godeps or else its own conf file, which is returned too.
+func transitiveImports(repoDir string) ([]conf.Import, *conf.Conf, error) {
+	transitiveDependencies, err := godep.Parse(repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var imports []conf.Import
+	for _, transitiveDependency := range transitiveDependencies {
+		imports = append(imports, conf.Import{
+			Package: transitiveDependency.Name,
+			Version: transitiveDependency.Reference,
+			Repo:    transitiveDependency.Repository,
+		})
+	}
+	if len(transitiveDependencies) > 0 {
+		return imports, nil, nil
+	}
+	config, err := parseTransitiveVendor(repoDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config.Imports, &config, nil
+}
+
+func parseTransitiveVendor(repoDir string) (conf.Conf, error) {
+	configFile := ""
+	for _, f := range []string{"vendor.conf", "trash.conf", "vndr.cfg", "vendor.manifest", "trash.yml", "glide.yaml", "glide.yml", "trash.yaml", "Gopkg.lock", "Gopkg.toml", "go.mod"} {
+		if _, err := os.Stat(filepath.Join(repoDir, f)); err == nil {
+			configFile = filepath.Join(repoDir, f)
+			break
+		}
+	}
+	if configFile == "" {
+		return conf.Conf{}, nil
+	}
+	trashConf, err := conf.Parse(configFile)
+	if err != nil {
+		return conf.Conf{}, err
+	}
+	return *trashConf, nil
+}
+
+func (p *project) updateTrash(trashConf *conf.Conf) error {
+	// TODO collect imports, create `trashConf *conf.Trash`
+	rootPackage, err := p.rootPackage()
+	if err != nil {
+		return err
+	}
+
+	importsLen := 0
+
+	imports := collectImports(p.opts.Dir, rootPackage, p.cache.repoDir, p.targetDirs())
+	for len(imports) > importsLen {
+		importsLen = len(imports)
+		var heads []conf.Import
+		for pkg := range imports {
+			i, ok := trashConf.Get(pkg)
+			if !ok {
+				i = conf.Import{Package: pkg}
+			}
+			i.Version = defaultBranch
+			if pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/") {
+				continue
+			}
+			heads = append(heads, i)
+		}
+		if err := p.forEachImport(heads, func(i conf.Import) error {
+			if err := p.cache.prepare(i); err != nil {
+				return err
+			}
+			return p.cache.checkout(i)
+		}); err != nil {
+			return err
+		}
+		imports = collectImports(p.opts.Dir, rootPackage, p.cache.repoDir, p.targetDirs())
+	}
+
+	trashConf.Package = rootPackage // Overwrite possibly non existent root package name
+	trashConf.Imports = nil         // Drop any old imports to include only new ones
+	for pkg := range imports {
+		if pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/") {
+			continue
+		}
+		pkg, err := p.cache.topLevel(pkg)
+		if err != nil {
+			return err
+		}
+		i, ok := trashConf.Get(pkg) // Get uses importMap for meta fields, which was preserved above
+		if !ok {
+			i = conf.Import{Package: pkg}
+		}
+		if _, ok := conf.ParseConstraint(i.Version); !ok && !i.Lock {
+			i.Version, err = p.cache.latestVersion(i)
+			if err != nil {
+				return err
+			}
+			if trashConf.IsGoMod() {
+				if i.ModVersion, err = p.modVersion(i); err != nil {
+					return err
+				}
+			}
+		}
+		trashConf.Imports = append(trashConf.Imports, i)
+	}
+	trashConf.Dedupe()
+
+	return p.dumpConf(trashConf)
+}
+
+// dumpConf writes trashConf back to the conf file it was read from.
+func (p *project) dumpConf(trashConf *conf.Conf) error {
+	if err := trashConf.Dump(p.outConfFile()); err != nil {
+		return err
+	}
+	p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: p.outConfFile()})
+	return nil
+}
+
+// vendor checks out the imports and copies them to the target dir. Without
+// update, the imports which are in the target dir already, as the lock says,
+// are left as they are: it returns those too.
+func (p *project) vendor(trashConf *conf.Conf, update bool) (map[string]revision, map[string]bool, error) {
+	keep, vendorDir := p.opts.Keep, p.opts.TargetDir
+	logrus.WithFields(logrus.Fields{"keep": keep, "dir": p.opts.Dir, "trashConf": trashConf}).Debug("vendor")
+
+	for _, i := range trashConf.Imports {
+		if i.Version == "" {
+			return nil, nil, &ConfError{ConfFile: trashConf.ConfFile(), Package: i.Package, Reason: "has no version"}
+		}
+	}
+
+	unchanged := map[string]bool{}
+	if !update {
+		var err error
+		if unchanged, err = p.unchanged(trashConf); err != nil {
+			return nil, nil, err
+		}
+	}
+	var imports []conf.Import
+	for _, i := range trashConf.Imports {
+		if !(update && i.Lock) && !unchanged[i.Package] {
+			imports = append(imports, i)
+		}
+	}
+	tags, err := p.checkoutImports(imports)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, i := range trashConf.Imports {
+		if update && i.Lock {
+			tags[i.Package] = i.Tag
+		}
+	}
+
+	// Record what got checked out
+	revisions := map[string]revision{}
+	for _, i := range trashConf.Imports {
+		if unchanged[i.Package] {
+			rev, err := p.lockedRevision(i)
+			if err != nil {
+				return nil, nil, err
+			}
+			revisions[i.Package] = rev
+			continue
+		}
+		ref := "HEAD"
+		if update && i.Lock {
+			ref = i.Version
+		}
+		if rev, ok := p.revision(i, ref, tags[i.Package]); ok {
+			revisions[i.Package] = rev
+		}
+	}
+
+	if update {
+		logrus.Info("Copying deps...")
+		for _, i := range trashConf.Imports {
+			if err := p.opts.canceled(); err != nil {
+				return nil, nil, err
+			}
+			if !i.Lock {
+				if err := os.RemoveAll(path.Join(vendorDir, i.Package)); err != nil {
+					return nil, nil, err
+				}
+				if err := cpy(vendorDir, p.cache.repoDir(i.Package), i, p.opts.CopyMode); err != nil {
+					return nil, nil, err
+				}
+				p.opts.Events.OnEvent(Event{Kind: EventCopy, Package: i.Package, Version: i.Version, Path: path.Join(vendorDir, i.Package)})
+			}
+		}
+		logrus.Info("Copying deps... Done")
+	} else {
+		if err := p.removeChanged(trashConf, unchanged); err != nil {
+			return nil, nil, err
+		}
+		os.MkdirAll(vendorDir, 0755)
+
+		logrus.Info("Copying deps...")
+		if err := p.copyImports(imports); err != nil {
+			return nil, nil, err
+		}
+		logrus.Info("Copying deps... Done")
+	}
+	if !keep {
+		if err := filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if _, d := filepath.Split(path); d == ".git" {
+				logrus.Infof("removing '%s", path)
+				if err := os.RemoveAll(path); err != nil || !info.IsDir() {
+					return err
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}); err != nil {
+			logrus.Errorf("Error stripping .git dirs: %s", err)
+			return nil, nil, err
+		}
+	}
+
+	return revisions, unchanged, nil
+}
+
+// revision returns the revision of ref in the repo of i, with tag, and
+// whether there is one.
+func (p *project) revision(i conf.Import, ref, tag string) (revision, bool) {
+	rev, err := p.cache.revision(i, ref)
+	if err != nil {
+		logrus.Debugf("Could not get the revision of '%s': %v", i.Package, err)
+		return rev, false
+	}
+	rev.Tag = tag
+	if rev.Remote, err = p.cache.remote(i); err != nil {
+		logrus.Debugf("Could not get the remote of '%s': %v", i.Package, err)
+	}
+	return rev, true
+}
+
+// checkoutImports checks out imports in the cache, returning the tags their
+// version constraints resolved to.
+func (p *project) checkoutImports(imports []conf.Import) (map[string]string, error) {
+	var mutex sync.Mutex
+	tags := map[string]string{}
+	err := p.forEachImport(imports, func(i conf.Import) error {
+		if err := p.cache.prepare(i); err != nil {
+			return err
+		}
+		if i.Commit == "" {
+			tag, err := p.cache.resolveTag(i)
+			if err != nil {
+				return err
+			}
+			if tag != "" {
+				i.Tag = tag
+			}
+		}
+		mutex.Lock()
+		tags[i.Package] = i.Tag
+		mutex.Unlock()
+		return p.cache.checkout(i)
+	})
+	return tags, err
+}
+
+// forEachImport runs f for imports, p.opts.Jobs at a time. Offline, it goes
+// on when an import isn't in the cache, to fail with all of those missing.
+func (p *project) forEachImport(imports []conf.Import, f func(i conf.Import) error) error {
+	f = p.cancelable(f)
+	if !p.opts.Offline {
+		return forEachImport(imports, p.opts.Jobs, f)
+	}
+	var mutex sync.Mutex
+	missing := &OfflineError{}
+	if err := forEachImport(imports, p.opts.Jobs, func(i conf.Import) error {
+		err := f(i)
+		if e, ok := err.(*PackageError); ok {
+			if _, ok := e.Err.(notCachedError); ok {
+				mutex.Lock()
+				missing.Missing = append(missing.Missing, e)
+				mutex.Unlock()
+				return nil
+			}
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(missing.Missing) > 0 {
+		sort.Slice(missing.Missing, func(k, j int) bool { return missing.Missing[k].Package < missing.Missing[j].Package })
+		return missing
+	}
+	return nil
+}
+
+// cancelable returns f, which fails with ErrInterrupted once the operation
+// is canceled instead of running.
+func (p *project) cancelable(f func(i conf.Import) error) func(i conf.Import) error {
+	return func(i conf.Import) error {
+		if err := p.opts.canceled(); err != nil {
+			return err
+		}
+		return f(i)
+	}
+}
+
+// copyImports copies the checked out imports to the target dir.
+func (p *project) copyImports(imports []conf.Import) error {
+	vendorDir := p.opts.TargetDir
+	for _, i := range imports {
+		if err := p.opts.canceled(); err != nil {
+			return err
+		}
+		if err := cpy(vendorDir, p.cache.repoDir(i.Package), i, p.opts.CopyMode); err != nil {
+			return err
+		}
+		p.opts.Events.OnEvent(Event{Kind: EventCopy, Package: i.Package, Version: i.Version, Path: path.Join(vendorDir, i.Package)})
+	}
+	return nil
+}
+
+// unchanged returns the imports of trashConf which are pinned to the commit
+// in the lock and whose files in the target dir still hash to what the lock
+// says. Staging and transitive imports never are: what they bring is read
+// from their checkout. Neither are imports nested in the others, or the
+// other way around, unless the others are unchanged too.
+func (p *project) unchanged(trashConf *conf.Conf) (map[string]bool, error) {
+	r := map[string]bool{}
+	if p.opts.Keep {
+		// the files pruned before have to come back
+		return r, nil
+	}
+	for _, i := range trashConf.Imports {
+		l, ok := p.lock.Get(i.Package)
+		if !ok || i.Staging || i.Transitive || l.Hash == "" || l.Commit == "" ||
+			i.Commit != l.Commit || i.Version != l.Version || i.Repo != l.Repo {
+			continue
+		}
+		files, err := util.HashFiles(path.Join(p.opts.TargetDir, i.Package), nestedImports(i.Package, trashConf.Imports))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if util.TreeHash(files) == l.Hash {
+			r[i.Package] = true
+		}
+	}
+	for _, i := range trashConf.Imports {
+		if !r[i.Package] {
+			unmarkNested(r, i.Package)
+		}
+	}
+	for pkg := range r {
+		logrus.Debugf("'%s' is vendored already", pkg)
+	}
+	return r, nil
+}
+
+// unmarkNested takes the imports nested in pkg, or which pkg is nested in,
+// out of unchanged, along with those nested in them, and so on.
+func unmarkNested(unchanged map[string]bool, pkg string) {
+	for other := range unchanged {
+		if strings.HasPrefix(other, pkg+"/") || strings.HasPrefix(pkg, other+"/") {
+			delete(unchanged, other)
+			unmarkNested(unchanged, other)
+		}
+	}
+}
+
+// lockedRevision returns the revision the lock has for i.
+func (p *project) lockedRevision(i conf.Import) (revision, error) {
+	l, _ := p.lock.Get(i.Package)
+	rev := revision{Commit: l.Commit, Remote: l.Remote, Tag: l.Tag}
+	if p.opts.Modules {
+		// pseudo-versions need the time of the commit, from the cache
+		r, err := p.cache.revision(i, l.Commit)
+		if err != nil {
+			return rev, &PackageError{Package: i.Package, Err: err}
+		}
+		rev.Time = r.Time
+	}
+	return rev, nil
+}
+
+// removeChanged removes from the target dir the files of every import which
+// isn't unchanged, and those which belong to no import.
+func (p *project) removeChanged(trashConf *conf.Conf, unchanged map[string]bool) error {
+	vendorDir := p.opts.TargetDir
+	stray, err := strayFiles(vendorDir, trashConf.Imports)
+	if err != nil {
+		return err
+	}
+	for _, f := range stray {
+		if err := os.Remove(filepath.Join(vendorDir, filepath.FromSlash(f))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, i := range trashConf.Imports {
+		if !unchanged[i.Package] {
+			if err := os.RemoveAll(path.Join(vendorDir, i.Package)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyPruned copies again the unchanged imports which miss packages that
+// the project needs now, because an earlier run pruned them, until none do.
+func (p *project) copyPruned(trashConf *conf.Conf, unchanged map[string]bool, revisions map[string]revision) error {
+	if len(unchanged) == 0 {
+		return nil
+	}
+	rootPackage, err := p.rootPackage()
+	if err != nil {
+		return err
+	}
+	targetDir := p.opts.TargetDir
+	for {
+		if err := p.prune(trashConf, nil); err != nil {
+			return err
+		}
+		imports := collectImports(p.opts.Dir, rootPackage, inGopath(targetDir), p.targetDirs())
+		for _, pkg := range trashConf.Packages {
+			imports[pkg] = true
+		}
+		before := map[string]bool{}
+		for pkg := range unchanged {
+			before[pkg] = true
+		}
+		for pkg := range imports {
+			if _, err := os.Stat(path.Join(targetDir, pkg)); !os.IsNotExist(err) {
+				continue
+			}
+			owner := ""
+			for _, i := range trashConf.Imports {
+				if (pkg == i.Package || strings.HasPrefix(pkg, i.Package+"/")) && len(i.Package) > len(owner) {
+					owner = i.Package
+				}
+			}
+			if unchanged[owner] {
+				logrus.Infof("Package '%s' was pruned before: copying '%s' again", pkg, owner)
+				delete(unchanged, owner)
+				unmarkNested(unchanged, owner)
+			}
+		}
+		var again []conf.Import
+		for _, i := range trashConf.Imports {
+			if before[i.Package] && !unchanged[i.Package] {
+				again = append(again, i)
+				if err := os.RemoveAll(path.Join(targetDir, i.Package)); err != nil {
+					return err
+				}
+			}
+		}
+		if len(again) == 0 {
+			return nil
+		}
+		tags, err := p.checkoutImports(again)
+		if err != nil {
+			return err
+		}
+		for _, i := range again {
+			if rev, ok := p.revision(i, "HEAD", tags[i.Package]); ok {
+				revisions[i.Package] = rev
+			}
+		}
+		if err := p.copyImports(again); err != nil {
+			return err
+		}
+	}
+}
+
+// cpy copies the files of i from repoDir, the tree it's checked out in, to
+// its dir in vendorDir.
+func cpy(vendorDir, repoDir string, i conf.Import, mode util.CopyMode) error {
+	target := path.Join(vendorDir, i.Package)
+	if err := util.CopyTree(repoDir, target, mode); err != nil {
+		return &PackageError{Package: i.Package, Err: fmt.Errorf("could not copy '%s' to '%s': %v", repoDir, target, err)}
+	}
+	return nil
+}
+
+func parentPackages(root, p string) util.Packages {
+	r := util.Packages{}
+	lenRoot := len(root)
+	for len(p) > lenRoot {
+		r[p] = true
+		p, _ = path.Split(p)
+		if len(p) > 0 && p[len(p)-1] == '/' {
+			p = p[:len(p)-1]
+		}
+	}
+	return r
+}
+
+// inGopath returns the func finding packages in the GOPATH-like dir root.
+func inGopath(root string) func(pkg string) string {
+	return func(pkg string) string {
+		return root + "/" + pkg
+	}
+}
+
+// listImports lists the imports of pkg, which is in dir if it's in the
+// project, and in libDir(pkg) otherwise.
+func listImports(dir, rootPackage string, libDir func(string) string, pkg string) <-chan util.Packages {
+	pkgPath, lib := dir, false
+	if pkg != rootPackage {
+		if strings.HasPrefix(pkg, rootPackage+"/") {
+			pkgPath = filepath.Join(dir, pkg[len(rootPackage)+1:])
+		} else {
+			pkgPath, lib = libDir(pkg), true
+		}
+	}
+	logrus.Debugf("listImports, pkgPath: '%s'", pkgPath)
+	sch := make(chan string)
+	noVendoredTests := func(info os.FileInfo) bool {
+		if lib && strings.HasSuffix(info.Name(), "_test.go") {
+			return false
+		}
+		return true
+	}
+	go func() {
+		defer close(sch)
+
+		// Gather all the Go imports
+		ps, err := parser.ParseDir(token.NewFileSet(), pkgPath, noVendoredTests, parser.ImportsOnly)
+		if err != nil {
+			if os.IsNotExist(err) {
+				logrus.Debugf("listImports, pkgPath does not exist: %s", err)
+			} else {
+				logrus.Errorf("Error parsing imports, pkgPath: '%s', err: '%s'", pkgPath, err)
+			}
+			return
+		}
+		logrus.Infof("Collecting imports for package '%s'", pkg)
+		for _, p := range ps {
+			for _, f := range p.Files {
+				for _, v := range f.Imports {
+					imp := v.Path.Value[1 : len(v.Path.Value)-1]
+					if pkgComponents := strings.Split(imp, "/"); !strings.Contains(pkgComponents[0], ".") {
+						continue
+					} else if pkgComponents[0] == "." || pkgComponents[0] == ".." {
+						imp = filepath.Clean(filepath.Join(pkg, imp))
+					}
+					if imp == rootPackage || strings.HasPrefix(imp, rootPackage+"/") {
+						continue
+					}
+					sch <- imp
+					logrus.Debugf("listImports, sch <- '%s'", v.Path.Value[1:len(v.Path.Value)-1])
+				}
+			}
+		}
+		// Gather all the CGO imports
+		ps, err = parser.ParseDir(token.NewFileSet(), pkgPath, noVendoredTests, parser.ParseComments)
+		if err != nil {
+			if os.IsNotExist(err) {
+				logrus.Debugf("listImports, pkgPath does not exist: %s", err)
+			} else {
+				logrus.Errorf("Error parsing comments, pkgPath: '%s', err: '%s'", pkgPath, err)
+			}
+			return
+		}
+		logrus.Infof("Collecting CGO imports for package '%s'", pkg)
+		for _, p := range ps {
+			for _, f := range p.Files {
+				// Drill down to locate C preable definitions
+				for _, decl := range f.Decls {
+					d, ok := decl.(*ast.GenDecl)
+					if !ok {
+						continue
+					}
+					for _, spec := range d.Specs {
+						s, ok := spec.(*ast.ImportSpec)
+						if !ok || s.Path.Value != `"C"` {
+							continue
+						}
+						cg := s.Doc
+						if cg == nil && len(d.Specs) == 1 {
+							cg = d.Doc
+						}
+						if cg != nil {
+							// Extract any includes from the preamble
+							for _, line := range strings.Split(cg.Text(), "\n") {
+								if line = strings.TrimSpace(line); strings.HasPrefix(line, "#include \"") {
+									if includePath := filepath.Dir(line[10 : len(line)-1]); includePath != "." {
+										if _, err := os.Stat(filepath.Join(pkgPath, includePath)); !os.IsNotExist(err) {
+											sch <- filepath.Clean(filepath.Join(pkg, includePath))
+										}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}()
+	lnc := util.MergeStrChans(sch, util.OneStr(pkg))
+	return chanPackagesFromLines(lnc)
+}
+
+func chanPackagesFromLines(lnc <-chan string) <-chan util.Packages {
+	return util.ChanPackages(func() util.Packages {
+		r := util.Packages{}
+		for v := range lnc {
+			r[v] = true
+		}
+		return r
+	})
+}
+
+// listPackages lists the packages of the project in dir, leaving out the
+// target dirs.
+func listPackages(dir, rootPackage string, targetDirs []string) util.Packages {
+	skip := map[string]bool{}
+	for _, d := range targetDirs {
+		skip[d] = true
+	}
+	r := util.Packages{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logrus.Warning(err)
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if skip[path] || rel != "." && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		logrus.Debugf("path: '%s'", rel)
+		pkgs, err := parser.ParseDir(token.NewFileSet(), path, nil, parser.PackageClauseOnly)
+		if err != nil {
+			logrus.Error(err)
+			return err
+		}
+		if len(pkgs) > 0 {
+			logrus.Debugf("Adding package: '%s'", rel)
+			if rel == "." {
+				r[rootPackage] = true
+			} else {
+				r[rootPackage+"/"+rel] = true
+			}
+		}
+		return nil
+	})
+	return r
+}
+
+func collectImports(dir, rootPackage string, libDir func(string) string, targetDirs []string) util.Packages {
+	logrus.Infof("Collecting packages in '%s'", rootPackage)
+
+	imports := util.Packages{}
+	packages := listPackages(dir, rootPackage, targetDirs)
+
+	seenPackages := util.Packages{}
+	for len(packages) > 0 {
+		cs := []<-chan util.Packages{}
+		for p := range packages {
+			cs = append(cs, listImports(dir, rootPackage, libDir, p))
+		}
+		for ps := range util.MergePackagesChans(cs...) {
+			imports.Merge(ps)
+		}
+		seenPackages.Merge(packages)
+		packages = util.Packages{}
+		for i := range imports {
+			if !seenPackages[i] {
+				packages[i] = true
+			}
+		}
+	}
+
+	for p := range imports {
+		logrus.Debugf("Keeping: '%s'", p)
+	}
+
+	logrus.Debugf("imports len: %v", len(imports))
+	return imports
+}
+
+func removeUnusedImports(imports util.Packages, targetDir string, updatePackages map[string]bool, events Listener) error {
+	importsParents := util.Packages{}
+	for i := range imports {
+		importsParents.Merge(parentPackages("", i))
+	}
+	return filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		logrus.Debugf("removeUnusedImports, path: '%s', err: '%v'", path, err)
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if path == targetDir {
+			return nil
+		}
+		shouldClean := false
+		if updatePackages == nil || len(updatePackages) == 0 {
+			shouldClean = true
+		}
+		for pkg := range updatePackages {
+			if pkgDir := filepath.Join(targetDir, pkg); path == pkgDir || strings.HasPrefix(path, pkgDir+"/") {
+				shouldClean = true
+				break
+			}
+		}
+		if !shouldClean {
+			return nil
+		}
+		if !info.IsDir() {
+			if filepath.Dir(path) == targetDir {
+				return nil // like modules.txt, left from the run before
+			}
+			pkg := path[len(targetDir+"/"):strings.LastIndex(path, "/")]
+			if strings.HasSuffix(path, "_test.go") || strings.HasSuffix(path, ".go") && !imports[pkg] {
+				logrus.Debugf("Removing unused source file: '%s'", path)
+				if err := os.Remove(path); err != nil {
+					if os.IsNotExist(err) {
+						return nil
+					}
+					logrus.Errorf("Error removing file: '%s', err: '%v'", path, err)
+					return err
+				}
+				events.OnEvent(Event{Kind: EventRemove, Package: pkg, Path: path})
+			}
+			return nil
+		}
+		pkg := path[len(targetDir+"/"):]
+		if !imports[pkg] && !importsParents[pkg] {
+			logrus.Infof("Removing unused dir: '%s'", path)
+			err := os.RemoveAll(path)
+			if err == nil {
+				events.OnEvent(Event{Kind: EventRemove, Package: pkg, Path: path})
+				return filepath.SkipDir
+			}
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			logrus.Errorf("Error removing unused dir, path: '%s', err: '%v'", path, err)
+			return err
+		}
+		return nil
+	})
+}
+
+func removeExcludes(excludes []string, targetDir string, events Listener) error {
+	exclude := make(map[string]bool)
+	for _, dir := range excludes {
+		exclude[dir] = true
+	}
+	return filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		logrus.Debugf("removeExcludes, path: '%s', err: '%v'", path, err)
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if path == targetDir {
+			return nil
+		}
+		pkg := path[len(targetDir+"/"):]
+		if exclude[pkg] {
+			logrus.Infof("Removing excluded dir: '%s'", path)
+			err := os.RemoveAll(path)
+			if err == nil {
+				events.OnEvent(Event{Kind: EventRemove, Package: pkg, Path: path})
+				return filepath.SkipDir
+			}
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			logrus.Errorf("Error removing excluded dir, path: '%s', err: '%v'", path, err)
+			return err
+		}
+		return nil
+	})
+}
+
+func removeEmptyDirs(targetDir string) error {
+	for count := 1; count != 0; {
+		count = 0
+		if err := filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+			logrus.Debugf("removeEmptyDirs, path: '%s', err: '%v'", path, err)
+			if os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			if err != nil {
+				return err
+			}
+			if path == targetDir {
+				return nil
+			}
+			if info.IsDir() {
+				err := os.Remove(path)
+				if err == nil {
+					logrus.Infof("Removed Empty dir: '%s'", path)
+					count++
+					return filepath.SkipDir
+				}
+				if os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guessRootPackage finds the import path of dir in gopath.
+func guessRootPackage(dir, gopath string) (string, error) {
+	logrus.Warn("Trying to guess the root package using GOPATH. It's best to specify it in `vendor.conf`")
+	logrus.Warnf("GOPATH is '%s'", gopath)
+	if gopath == "" || strings.Contains(gopath, ":") {
+		return "", errors.Wrap(ErrNoRootPackage, "GOPATH not set or is not a single path")
+	}
+	srcPath := filepath.Clean(path.Join(gopath, "src"))
+	if !strings.HasPrefix(dir, srcPath+"/") {
+		return "", errors.Wrapf(ErrNoRootPackage, "'%s' is not a subdir of $GOPATH/src", dir)
+	}
+	if _, err := os.Stat(srcPath); err != nil {
+		return "", errors.Wrapf(ErrNoRootPackage, "$GOPATH/src does not exist or something: %s", err)
+	}
+	logrus.Debugf("srcPath: '%s'", srcPath)
+	return dir[len(srcPath+"/"):], nil
+}
+
+// cleanup prunes the target dir and writes the lock of all the imports.
+func (p *project) cleanup(revisions map[string]revision) error {
+	trashConf := p.trashConf
+	if err := p.prune(trashConf, nil); err != nil {
+		return err
+	}
+	lock := conf.Lock{
+		Package:  trashConf.Package,
+		Imports:  []conf.LockedImport{},
+		Excludes: trashConf.Excludes,
+	}
+	for _, i := range trashConf.Imports {
+		locked, err := p.lockImport(trashConf, i, revisions[i.Package])
+		if err != nil {
+			return err
+		}
+		if locked != nil {
+			lock.Imports = append(lock.Imports, *locked)
+		}
+	}
+	return p.dumpLock(&lock)
+}
+
+// dumpLock writes lock to the lock file.
+func (p *project) dumpLock(lock *conf.Lock) error {
+	if err := lock.Dump(p.opts.OutLockFile); err != nil {
+		return err
+	}
+	p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: p.opts.OutLockFile})
+	return nil
+}
+
+// prune removes excluded and unused packages from the target dir. With
+// updatePackages, only the dirs of those packages are touched.
+func (p *project) prune(trashConf *conf.Conf, updatePackages map[string]bool) error {
+	rootPackage, err := p.rootPackage()
+	if err != nil {
+		return err
+	}
+	targetDir, events := p.opts.TargetDir, p.opts.Events
+
+	logrus.Debugf("rootPackage: '%s'", rootPackage)
+
+	imports := collectImports(p.opts.Dir, rootPackage, inGopath(targetDir), p.targetDirs())
+	excludes := trashConf.Excludes
+	if len(updatePackages) > 0 {
+		excludes = nil
+		for _, e := range trashConf.Excludes {
+			for pkg := range updatePackages {
+				if e == pkg || strings.HasPrefix(e, pkg+"/") {
+					excludes = append(excludes, e)
+				}
+			}
+		}
+	}
+	if err := removeExcludes(excludes, targetDir, events); err != nil {
+		logrus.Errorf("Error removing excluded dirs: %v", err)
+	}
+	for _, im := range trashConf.Packages {
+		logrus.Infof("Must include package %s", im)
+		imports[im] = true
+	}
+	if err := removeUnusedImports(imports, targetDir, updatePackages, events); err != nil {
+		logrus.Errorf("Error removing unused dirs: %v", err)
+	}
+	emptyDirs := []string{targetDir}
+	if len(updatePackages) > 0 {
+		emptyDirs = nil
+		for pkg := range updatePackages {
+			emptyDirs = append(emptyDirs, path.Join(targetDir, pkg))
+		}
+	}
+	for _, d := range emptyDirs {
+		if err := removeEmptyDirs(d); err != nil {
+			logrus.Errorf("Error removing empty dirs: %v", err)
+		}
+	}
+	return nil
+}
+
+// lockImport hashes what's left of i in the target dir. It returns nil if nothing is left.
+func (p *project) lockImport(trashConf *conf.Conf, i conf.Import, rev revision) (*conf.LockedImport, error) {
+	pth := path.Join(p.opts.TargetDir, i.Package)
+	if _, err := os.Stat(pth); err != nil {
+		if os.IsNotExist(err) {
+			logrus.Warnf("Package '%s' has been completely removed: it's probably useless (in %s)", i.Package, trashConf.ConfFile())
+		} else {
+			logrus.Errorf("os.Stat() failed for: %s", pth)
+		}
+		return nil, nil
+	}
+	files, err := util.HashFiles(pth, nestedImports(i.Package, trashConf.Imports))
+	if err != nil {
+		return nil, err
+	}
+	return &conf.LockedImport{
+		Package: i.Package,
+		Version: i.Version,
+		Repo:    i.Repo,
+		Tag:     rev.Tag,
+		Commit:  rev.Commit,
+		Remote:  rev.Remote,
+		Hash:    util.TreeHash(files),
+	}, nil
+}
+
+// inDir resolves p, which is relative to dir unless it's absolute.
+func inDir(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// nestedImports tells which dirs inside pkg belong to other imports.
+func nestedImports(pkg string, imports []conf.Import) func(rel string) bool {
+	return func(rel string) bool {
+		for _, i := range imports {
+			if i.Package == pkg+"/"+rel {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rdeusser/trash/util"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParentPackages(t *testing.T) {
+	assert := require.New(t)
+
+	packages := parentPackages("", "github.com/stretchr/testify/require")
+	assert.Len(packages, 4)
+	assert.True(packages["github.com"])
+	assert.True(packages["github.com/stretchr"])
+	assert.True(packages["github.com/stretchr/testify"])
+	assert.True(packages["github.com/stretchr/testify/require"])
+}
+
+func TestParseDir(t *testing.T) {
+	assert := require.New(t)
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", nil, parser.ImportsOnly)
+	if err != nil {
+		assert.Fail(err.Error())
+		return
+	}
+	for pkgName, pkg := range pkgs {
+		fmt.Printf("pkg: %s\n", pkgName)
+		if len(pkg.Files) == 0 {
+			fmt.Println("  (no files)")
+		}
+		for name, f := range pkg.Files {
+			fmt.Println("  " + name)
+			for _, v := range f.Imports {
+				fmt.Println("    " + v.Path.Value[1:len(v.Path.Value)-1])
+			}
+		}
+	}
+}
+
+func TestListPackages(t *testing.T) {
+	assert := require.New(t)
+	p := listPackages("..", "github.com/rancher/trash", []string{"../vendor"})
+	logrus.Debug(p)
+	assert.Equal(4, len(p))
+	assert.Contains(p, "github.com/rancher/trash")
+	assert.Contains(p, "github.com/rancher/trash/engine")
+	assert.Contains(p, "github.com/rancher/trash/util")
+	assert.Contains(p, "github.com/rancher/trash/conf")
+}
+
+func TestListPackagesTarget(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-packages")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	for _, pkg := range []string{".", "vendor", "deps/example.com/a", "scratch/example.com/a"} {
+		assert.NoError(os.MkdirAll(filepath.Join(dir, pkg), 0755))
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, pkg, "a.go"), []byte("package a\n"), 0644))
+	}
+
+	// with --target deps, vendor is a package of the project like any other
+	p := listPackages(dir, "example.com/proj", []string{filepath.Join(dir, "scratch"), filepath.Join(dir, "deps")})
+	assert.Equal(util.Packages{"example.com/proj": true, "example.com/proj/vendor": true}, p)
+}
+
+func TestRemoveUnusedImports(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-prune")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "example.com", "a", "unused"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "modules.txt"), []byte("# example.com/a v1.0.0\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "example.com", "a", "a.go"), []byte("package a\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "example.com", "a", "unused", "u.go"), []byte("package unused\n"), 0644))
+
+	imports := util.Packages{"example.com/a": true}
+	assert.NoError(removeUnusedImports(imports, dir, nil, nopListener{}))
+	assert.FileExists(filepath.Join(dir, "modules.txt"))
+	assert.FileExists(filepath.Join(dir, "example.com", "a", "a.go"))
+	_, err = os.Stat(filepath.Join(dir, "example.com", "a", "unused"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UpdatePackages updates just the imports named in args, as `pkg` (to the
+// latest tag) or `pkg@version`. Nothing outside of their dirs in the target
+// dir changes, and only their lines in the conf file do.
+func UpdatePackages(opts Options, args []string) error {
+	p, err := loadProject(opts, false)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	trashConf := p.trashConf
+
+	return p.stage(func() error {
+		updated := map[string]bool{}
+		revisions := map[string]revision{}
+		for _, arg := range args {
+			if err := p.opts.canceled(); err != nil {
+				return err
+			}
+			pkg, version := arg, ""
+			if at := strings.LastIndex(arg, "@"); at > 0 {
+				pkg, version = arg[:at], arg[at+1:]
+			}
+			i, ok := trashConf.Get(pkg)
+			if !ok {
+				return &ConfError{ConfFile: trashConf.ConfFile(), Package: pkg, Reason: "is missing"}
+			}
+			if i.Lock && version == "" {
+				logrus.Warnf("Package '%s' is locked in %s, give it a version to update it anyway", pkg, trashConf.ConfFile())
+				continue
+			}
+
+			i.Commit, i.Tag = "", ""
+			if err := p.cache.prepare(i); err != nil {
+				return err
+			}
+			if _, ok := conf.ParseConstraint(i.Version); ok && version == "" {
+				version = i.Version // resolved again, to the latest matching tag
+			} else if version == "" {
+				if version, err = p.cache.latestVersion(i); err != nil {
+					return err
+				}
+			}
+			i.Version = version
+			logrus.Infof("Updating '%s' to '%s'", pkg, version)
+			if revisions[pkg], err = p.vendorImport(i); err != nil {
+				return err
+			}
+			mod := ""
+			if trashConf.IsGoMod() {
+				// go.mod takes module versions, not branches or commits
+				if mod, err = moduleVersion(i, revisions[pkg]); err != nil {
+					return err
+				}
+			}
+			if err := trashConf.SetVersion(p.outConfFile(), pkg, version, mod); err != nil {
+				return err
+			}
+			p.opts.Events.OnEvent(Event{Kind: EventWrite, Path: p.outConfFile()})
+			updated[pkg] = true
+		}
+		if len(updated) == 0 {
+			return nil
+		}
+
+		return p.relock(updated, revisions)
+	})
+}
+
+// vendorImport checks i out in the cache and copies it into the target dir in
+// place of whatever was there, returning the revision it got.
+func (p *project) vendorImport(i conf.Import) (revision, error) {
+	if i.Commit == "" {
+		tag, err := p.cache.resolveTag(i)
+		if err != nil {
+			return revision{}, err
+		}
+		i.Tag = tag
+	}
+	if err := p.cache.checkout(i); err != nil {
+		return revision{}, err
+	}
+
+	repoDir := p.cache.repoDir(i.Package)
+	rev, err := p.cache.revision(i, "HEAD")
+	if err != nil {
+		return rev, err
+	}
+	rev.Tag = i.Tag
+	rev.Remote, _ = p.cache.remote(i)
+
+	pkgDir := path.Join(p.opts.TargetDir, i.Package)
+	if err := os.RemoveAll(pkgDir); err != nil {
+		return rev, err
+	}
+	if err := cpy(p.opts.TargetDir, repoDir, i, p.opts.CopyMode); err != nil {
+		return rev, err
+	}
+	p.opts.Events.OnEvent(Event{Kind: EventCopy, Package: i.Package, Version: i.Version, Path: pkgDir})
+	if !p.opts.Keep {
+		if err := os.RemoveAll(path.Join(pkgDir, ".git")); err != nil {
+			return rev, err
+		}
+	}
+	return rev, nil
+}
+
+// relock prunes the changed packages and rewrites their entries in the lock
+// (dropping those no longer in the conf), and go.mod with Modules.
+func (p *project) relock(changed map[string]bool, revisions map[string]revision) error {
+	trashConf, lock := p.trashConf, p.lock
+	if !p.opts.Keep {
+		if err := p.prune(trashConf, changed); err != nil {
+			return err
+		}
+		if err := p.warnMissingImports(); err != nil {
+			return err
+		}
+	}
+
+	var imports []conf.LockedImport
+	for _, l := range lock.Imports {
+		if !changed[l.Package] {
+			imports = append(imports, l)
+		}
+	}
+	for pkg := range changed {
+		i, ok := trashConf.Get(pkg)
+		if !ok {
+			continue
+		}
+		locked, err := p.lockImport(trashConf, i, revisions[pkg])
+		if err != nil {
+			return err
+		}
+		if locked != nil {
+			imports = append(imports, *locked)
+		}
+	}
+	lock.Imports = imports
+	lock.Excludes = trashConf.Excludes
+	if err := p.dumpLock(lock); err != nil {
+		return err
+	}
+
+	if p.opts.Modules {
+		// the other imports haven't moved: get their revisions from the lock
+		if err := p.lockedRevisions(revisions); err != nil {
+			return err
+		}
+		return p.writeModules(revisions)
+	}
+	return nil
+}
+
+// lockedRevisions adds the revisions of the imports in the lock that are
+// missing from revisions, getting the time of their commits from the cache.
+func (p *project) lockedRevisions(revisions map[string]revision) error {
+	for _, l := range p.lock.Imports {
+		if _, ok := revisions[l.Package]; ok || l.Commit == "" {
+			continue
+		}
+		i, ok := p.trashConf.Get(l.Package)
+		if !ok {
+			i = conf.Import{Package: l.Package, Repo: l.Repo}
+		}
+		rev, err := p.cache.revision(i, l.Commit)
+		if err != nil {
+			return &PackageError{Package: l.Package, Err: err}
+		}
+		rev.Remote, rev.Tag = l.Remote, l.Tag
+		revisions[l.Package] = rev
+	}
+	return nil
+}
+
+// warnMissingImports points out the packages the project now needs which
+// are not in the target dir, because they were pruned or never vendored.
+func (p *project) warnMissingImports() error {
+	rootPackage, err := p.rootPackage()
+	if err != nil {
+		return err
+	}
+	targetDir := p.opts.TargetDir
+	for pkg := range collectImports(p.opts.Dir, rootPackage, inGopath(targetDir), p.targetDirs()) {
+		if pkg == rootPackage || strings.HasPrefix(pkg, rootPackage+"/") {
+			continue
+		}
+		if _, err := os.Stat(path.Join(targetDir, pkg)); os.IsNotExist(err) {
+			logrus.Warnf("Package '%s' is imported but missing from %s: run trash to vendor it", pkg, filepath.Base(targetDir))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rdeusser/trash/conf"
+
+	"github.com/Masterminds/vcs"
+	"github.com/sirupsen/logrus"
+)
+
+// repo is the clone of the repo of an import in the cache, in whatever VCS
+// it's kept. Refs are whatever the VCS can check out: commits, tags, and the
+// refs branch returns.
+type repo interface {
+	// prepare makes sure the repo is in the cache, getting it if it isn't.
+	prepare() error
+	// fetch gets the latest commits and tags from the remote.
+	fetch() error
+	// branch returns the ref of the branch called name, and whether there is one.
+	branch(name string) (string, bool)
+	// export writes the files of ref to dest.
+	export(ref, dest string) error
+	// latest returns the latest commit the repo has, on any branch.
+	latest() (string, error)
+	// tags lists the tags the repo has.
+	tags() ([]string, error)
+	// revision returns the commit of ref, and when it was made.
+	revision(ref string) (revision, error)
+	// remoteURL returns where the repo was got from.
+	remoteURL() (string, error)
+	// behind counts the commits from commit to ref.
+	behind(commit, ref string) (int, error)
+}
+
+// newRepo makes the repo of i in dir, the dir of i in cache c.
+type newRepo func(c *cache, dir string, i conf.Import) repo
+
+// backends are the kinds of VCS an import can name with its vcs option, and
+// the module proxy.
+var backends = map[string]newRepo{
+	"git":   newGitRepo,
+	"hg":    newVCSRepo(vcs.Hg),
+	"svn":   newVCSRepo(vcs.Svn),
+	"bzr":   newVCSRepo(vcs.Bzr),
+	"proxy": newProxyRepo,
+}
+
+// detectVCS guesses what kind of repo is in dir, or else at url. It's git
+// when there's no telling.
+func detectVCS(dir, url string) string {
+	if t, err := vcs.DetectVcsFromFS(dir); err == nil {
+		return string(t)
+	}
+	switch {
+	case strings.HasSuffix(url, ".git"):
+		return "git"
+	case strings.HasPrefix(url, "svn://") || strings.HasPrefix(url, "svn+"):
+		return "svn"
+	case strings.HasPrefix(url, "bzr://") || strings.HasPrefix(url, "bzr+") || strings.HasPrefix(url, "lp:"):
+		return "bzr"
+	case strings.HasPrefix(url, "hg::"):
+		return "hg"
+	}
+	return "git"
+}
+
+// repoMarker is the file in the dir of a vcsRepo which has the URL it was
+// cloned from in it, for imports that got their repo from a lookup.
+const repoMarker = ".trash-repo"
+
+// vcsRepo is a repo of one of the VCS that Masterminds/vcs knows about. It's
+// cloned in the dir of the import, and locked while it's worked on.
+type vcsRepo struct {
+	c    *cache
+	dir  string
+	i    conf.Import
+	kind vcs.Type
+}
+
+func newVCSRepo(kind vcs.Type) newRepo {
+	return func(c *cache, dir string, i conf.Import) repo {
+		return &vcsRepo{c: c, dir: dir, i: i, kind: kind}
+	}
+}
+
+func (r *vcsRepo) remote() string {
+	if r.i.Repo != "" {
+		return strings.TrimPrefix(r.i.Repo, "hg::")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(r.dir, repoMarker)); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return "https://" + r.i.Package
+}
+
+func (r *vcsRepo) vcs() (vcs.Repo, error) {
+	var v vcs.Repo
+	var err error
+	remote, _ := r.c.mirrors.rewrite(r.remote())
+	switch r.kind {
+	case vcs.Hg:
+		v, err = vcs.NewHgRepo(remote, r.dir)
+	case vcs.Svn:
+		v, err = vcs.NewSvnRepo(remote, r.dir)
+	case vcs.Bzr:
+		v, err = vcs.NewBzrRepo(remote, r.dir)
+	default:
+		err = fmt.Errorf("unknown vcs '%s'", r.kind)
+	}
+	if err != nil {
+		return nil, vcsError(err)
+	}
+	return v, nil
+}
+
+// vcsError keeps the output of the command that failed in the error.
+func vcsError(err error) error {
+	switch e := err.(type) {
+	case *vcs.LocalError:
+		if out := strings.TrimSpace(e.Out()); out != "" {
+			return fmt.Errorf("%v:\n%s", e, out)
+		}
+	case *vcs.RemoteError:
+		if out := strings.TrimSpace(e.Out()); out != "" {
+			return fmt.Errorf("%v:\n%s", e, out)
+		}
+	}
+	return err
+}
+
+func (r *vcsRepo) prepare() error {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err == nil && v.CheckLocal() {
+		return nil
+	}
+	if err != nil && err != vcs.ErrWrongRemote && err != vcs.ErrWrongVCS {
+		return err
+	}
+	if r.c.offline {
+		return notCachedError(fmt.Sprintf("the %s repo of '%s'", r.kind, r.i.Package))
+	}
+	logrus.Infof("Preparing cache for '%s' (%s)", r.i.Package, r.kind)
+	r.c.events.OnEvent(Event{Kind: EventClone, Package: r.i.Package})
+	remote := r.remote() // before the marker goes
+	if err := os.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	r.i.Repo = remote
+	if v, err = r.vcs(); err != nil {
+		return err
+	}
+	if err := v.Get(); err != nil {
+		return vcsError(err)
+	}
+	return ioutil.WriteFile(filepath.Join(r.dir, repoMarker), []byte(remote+"\n"), 0644)
+}
+
+func (r *vcsRepo) fetch() error {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return err
+	}
+	if r.kind == vcs.Hg {
+		// Update would move the working copy to the tip too
+		if out, err := v.RunFromDir("hg", "pull"); err != nil {
+			return fmt.Errorf("`hg pull` failed in '%s': %v:\n%s", r.dir, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return vcsError(v.Update())
+}
+
+func (r *vcsRepo) branch(name string) (string, bool) {
+	if name == defaultBranch {
+		switch r.kind {
+		case vcs.Hg:
+			name = "default"
+		case vcs.Svn:
+			return "HEAD", true
+		case vcs.Bzr:
+			return "last:1", true
+		}
+	}
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return name, false
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return name, false
+	}
+	branches, err := v.Branches()
+	if err != nil {
+		logrus.Debugf("Could not list the branches of '%s': %v", r.i.Package, err)
+		return name, false
+	}
+	for _, b := range branches {
+		if b == name {
+			return name, true
+		}
+	}
+	return name, false
+}
+
+// export writes the files of ref to dest with the export command of the VCS,
+// which leaves the working copy as it is and the metadata out.
+func (r *vcsRepo) export(ref, dest string) error {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return err
+	}
+	if dest, err = filepath.Abs(dest); err != nil {
+		return err
+	}
+	var args []string
+	switch r.kind {
+	case vcs.Hg:
+		args = []string{"hg", "archive", "--config", "ui.archivemeta=false", "-r", ref, dest}
+	case vcs.Svn:
+		args = []string{"svn", "export", "-r", ref, r.dir, dest}
+	case vcs.Bzr:
+		args = []string{"bzr", "export", "--format=dir", "-r", ref, dest}
+	default:
+		return fmt.Errorf("can't export %s repos", r.kind)
+	}
+	if out, err := v.RunFromDir(args[0], args[1:]...); err != nil {
+		return fmt.Errorf("`%s` failed in '%s': %v:\n%s", strings.Join(args[:2], " "), r.dir, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (r *vcsRepo) latest() (string, error) {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return "", err
+	}
+	version, err := v.Version()
+	return version, vcsError(err)
+}
+
+func (r *vcsRepo) tags() ([]string, error) {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := v.Tags()
+	return tags, vcsError(err)
+}
+
+func (r *vcsRepo) revision(ref string) (revision, error) {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return revision{}, err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return revision{}, err
+	}
+	info, err := v.CommitInfo(ref)
+	if err != nil {
+		return revision{}, vcsError(err)
+	}
+	return revision{Commit: info.Commit, Time: info.Date.UTC()}, nil
+}
+
+func (r *vcsRepo) remoteURL() (string, error) {
+	return r.remote(), nil
+}
+
+func (r *vcsRepo) behind(commit, ref string) (int, error) {
+	unlock, err := r.c.lock(r.dir)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	v, err := r.vcs()
+	if err != nil {
+		return 0, err
+	}
+	switch r.kind {
+	case vcs.Hg:
+		out, err := v.RunFromDir("hg", "log", "-r", fmt.Sprintf("only(%s, %s)", ref, commit), "--template", ".")
+		if err != nil {
+			return 0, fmt.Errorf("`hg log` failed in '%s': %v:\n%s", r.dir, err, out)
+		}
+		return len(strings.TrimSpace(string(out))), nil
+	case vcs.Svn:
+		// revisions are numbered
+		from, err := strconv.Atoi(commit)
+		if err != nil {
+			return 0, err
+		}
+		info, err := v.CommitInfo(ref)
+		if err != nil {
+			return 0, vcsError(err)
+		}
+		to, err := strconv.Atoi(info.Commit)
+		if err != nil {
+			return 0, err
+		}
+		return to - from, nil
+	}
+	return 0, fmt.Errorf("can't count the commits of %s repos", r.kind)
+}
@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCommit is a commit of a fakeRemote, with all the files of the repo.
+type fakeCommit struct {
+	id    string
+	time  time.Time
+	tags  []string
+	files map[string]string
+}
+
+// fakeRemote is an in-memory repo: its commits are in order, and its
+// branches point at them by id.
+type fakeRemote struct {
+	commits  []fakeCommit
+	branches map[string]string
+	exports  int
+}
+
+func (f *fakeRemote) find(ref string) (int, bool) {
+	if id, ok := f.branches[ref]; ok {
+		ref = id
+	}
+	for k, c := range f.commits {
+		if c.id == ref {
+			return k, true
+		}
+		for _, tag := range c.tags {
+			if tag == ref {
+				return k, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// fakeRepo is the repo of an import whose repo URL names a fakeRemote.
+type fakeRepo struct {
+	c      *cache
+	dir    string
+	i      conf.Import
+	remote *fakeRemote
+}
+
+func withFakeBackend(remotes map[string]*fakeRemote) func() {
+	backends["fake"] = func(c *cache, dir string, i conf.Import) repo {
+		return &fakeRepo{c: c, dir: dir, i: i, remote: remotes[i.Repo]}
+	}
+	return func() { delete(backends, "fake") }
+}
+
+func (r *fakeRepo) prepare() error {
+	if r.remote == nil {
+		return fmt.Errorf("no fake remote '%s'", r.i.Repo)
+	}
+	if _, err := os.Stat(r.dir); os.IsNotExist(err) {
+		r.c.events.OnEvent(Event{Kind: EventClone, Package: r.i.Package})
+	}
+	return os.MkdirAll(r.dir, 0755)
+}
+
+func (r *fakeRepo) fetch() error {
+	return nil
+}
+
+func (r *fakeRepo) branch(name string) (string, bool) {
+	_, ok := r.remote.branches[name]
+	return name, ok
+}
+
+func (r *fakeRepo) export(ref, dest string) error {
+	k, ok := r.remote.find(ref)
+	if !ok {
+		return fmt.Errorf("no ref '%s'", ref)
+	}
+	r.remote.exports++
+	for name, content := range r.remote.commits[k].files {
+		p := filepath.Join(dest, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepo) latest() (string, error) {
+	return r.remote.commits[len(r.remote.commits)-1].id, nil
+}
+
+func (r *fakeRepo) tags() ([]string, error) {
+	var tags []string
+	for _, c := range r.remote.commits {
+		tags = append(tags, c.tags...)
+	}
+	return tags, nil
+}
+
+func (r *fakeRepo) revision(ref string) (revision, error) {
+	k, ok := r.remote.find(ref)
+	if !ok {
+		return revision{}, fmt.Errorf("no ref '%s'", ref)
+	}
+	return revision{Commit: r.remote.commits[k].id, Time: r.remote.commits[k].time}, nil
+}
+
+func (r *fakeRepo) remoteURL() (string, error) {
+	return r.i.Repo, nil
+}
+
+func (r *fakeRepo) behind(commit, ref string) (int, error) {
+	from, ok := r.remote.find(commit)
+	if !ok {
+		return 0, fmt.Errorf("no commit '%s'", commit)
+	}
+	to, ok := r.remote.find(ref)
+	if !ok {
+		return 0, fmt.Errorf("no ref '%s'", ref)
+	}
+	return to - from, nil
+}
+
+func TestDetectVCS(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.Equal("git", detectVCS(dir, ""))
+	assert.Equal("git", detectVCS(dir, "https://example.com/repo.git"))
+	assert.Equal("svn", detectVCS(dir, "svn+ssh://example.com/repo"))
+	assert.Equal("bzr", detectVCS(dir, "lp:repo"))
+	assert.Equal("hg", detectVCS(dir, "hg::https://example.com/repo"))
+
+	assert.NoError(os.Mkdir(filepath.Join(dir, ".hg"), 0755))
+	assert.Equal("hg", detectVCS(dir, "https://example.com/repo.git"))
+}
+
+func TestVendorWithBackend(t *testing.T) {
+	assert := require.New(t)
+
+	source := func(s string) map[string]string {
+		return map[string]string{"fake.go": "package fake\n\nconst S = \"" + s + "\"\n"}
+	}
+	remote := &fakeRemote{
+		commits: []fakeCommit{
+			{id: "c1", time: time.Unix(1, 0).UTC(), tags: []string{"v1.0.0"}, files: source("one")},
+			{id: "c2", time: time.Unix(2, 0).UTC(), tags: []string{"v1.1.0"}, files: source("two")},
+			{id: "c3", time: time.Unix(3, 0).UTC(), files: source("three")},
+		},
+		branches: map[string]string{"master": "c3"},
+	}
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": remote})()
+
+	for _, c := range []struct {
+		version string
+		commit  string
+		content string
+	}{
+		{"v1.0.0", "c1", "one"},
+		{"^1.0", "c2", "two"},
+		{"master", "c3", "three"},
+	} {
+		dir, err := ioutil.TempDir("", "trash-vcs")
+		assert.NoError(err)
+		defer os.RemoveAll(dir)
+
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"example.com/fake\"\n"), 0644))
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "vendor.conf"), []byte("example.com/proj\n\nexample.com/fake "+c.version+" fake://fake vcs=fake\n"), 0644))
+
+		var events []EventKind
+		err = Vendor(Options{
+			Dir:      dir,
+			CacheDir: filepath.Join(dir, ".cache"),
+			Events: ListenerFunc(func(e Event) {
+				events = append(events, e.Kind)
+			}),
+			Jobs: 1,
+		})
+		assert.NoError(err, c.version)
+		assert.Contains(events, EventClone)
+		assert.Contains(events, EventCheckout)
+
+		bytes, err := ioutil.ReadFile(filepath.Join(dir, "vendor", "example.com", "fake", "fake.go"))
+		assert.NoError(err)
+		assert.Contains(string(bytes), c.content, c.version)
+
+		lock, err := conf.ParseLock(filepath.Join(dir, LockFile))
+		assert.NoError(err)
+		l, ok := lock.Get("example.com/fake")
+		assert.True(ok)
+		assert.Equal(c.commit, l.Commit, c.version)
+		assert.Equal("fake://fake", l.Remote)
+	}
+}
+
+func TestTreesAreReused(t *testing.T) {
+	assert := require.New(t)
+
+	remote := &fakeRemote{
+		commits: []fakeCommit{
+			{id: "c1", tags: []string{"v1.0.0"}, files: map[string]string{"fake.go": "package fake\n"}},
+		},
+	}
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": remote})()
+
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	var trees []string
+	for k := 0; k < 2; k++ {
+		work := filepath.Join(dir, fmt.Sprint("work", k))
+		assert.NoError(os.Mkdir(work, 0755))
+		c := &cache{dir: filepath.Join(dir, "cache"), work: work, events: nopListener{}}
+		i := conf.Import{Package: "example.com/fake", Version: "v1.0.0", Repo: "fake://fake", VCS: "fake"}
+		assert.NoError(c.prepare(i))
+		assert.NoError(c.checkout(i))
+		assert.FileExists(filepath.Join(c.repoDir("example.com/fake/sub"), "..", "fake.go"))
+		trees = append(trees, c.repoDir(i.Package))
+	}
+	assert.Equal(1, remote.exports)
+	assert.Equal(trees[0], trees[1])
+	assert.Equal(filepath.Join(dir, "cache", "trees", "fake", "c1"), trees[0])
+}
+
+func TestVendorIncremental(t *testing.T) {
+	assert := require.New(t)
+
+	remote := &fakeRemote{
+		commits: []fakeCommit{
+			{id: "c1", tags: []string{"v1.0.0"}, files: map[string]string{
+				"fake.go":     "package fake\n",
+				"unused/u.go": "package unused\n",
+			}},
+		},
+	}
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": remote})()
+
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nimport _ \"example.com/fake\"\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "vendor.conf"), []byte("example.com/proj\n\nexample.com/fake v1.0.0 fake://fake vcs=fake\n"), 0644))
+
+	vendor := func() []EventKind {
+		var events []EventKind
+		assert.NoError(Vendor(Options{
+			Dir:      dir,
+			CacheDir: filepath.Join(dir, ".cache"),
+			Events: ListenerFunc(func(e Event) {
+				events = append(events, e.Kind)
+			}),
+			Jobs: 1,
+		}))
+		return events
+	}
+	unused := filepath.Join(dir, "vendor", "example.com", "fake", "unused", "u.go")
+
+	assert.Contains(vendor(), EventCopy)
+	_, err = os.Stat(unused)
+	assert.True(os.IsNotExist(err), "unused packages are pruned")
+
+	events := vendor()
+	assert.NotContains(events, EventCheckout)
+	assert.NotContains(events, EventCopy)
+
+	// a package pruned before is needed now
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "unused.go"), []byte("package main\n\nimport _ \"example.com/fake/unused\"\n"), 0644))
+	assert.Contains(vendor(), EventCopy)
+	assert.FileExists(unused)
+
+	// so is a modified file
+	fake := filepath.Join(dir, "vendor", "example.com", "fake", "fake.go")
+	assert.NoError(ioutil.WriteFile(fake, []byte("package changed\n"), 0644))
+	assert.Contains(vendor(), EventCopy)
+	bytes, err := ioutil.ReadFile(fake)
+	assert.NoError(err)
+	assert.Equal("package fake\n", string(bytes))
+
+	diffs, err := Verify(Options{Dir: dir})
+	assert.NoError(err)
+	for _, d := range diffs {
+		assert.True(d.OK(), "%+v", d)
+	}
+}
+
+func TestMajorVersions(t *testing.T) {
+	assert := require.New(t)
+
+	remote := &fakeRemote{
+		commits: []fakeCommit{
+			{id: "c1", tags: []string{"v1.0.0"}, files: map[string]string{"fake.go": "package fake\n"}},
+			{id: "c2", tags: []string{"v2.0.0", "v2.1.0"}, files: map[string]string{"fake.go": "package fake // v2\n"}},
+			{id: "c3", tags: []string{"v3.0.0"}, files: map[string]string{"fake.go": "package fake // v2\n", "v3/go.mod": "module example.com/fake/v3\n", "v3/fake.go": "package fake // v3\n"}},
+		},
+		branches: map[string]string{"v4": "c3"},
+	}
+	defer withFakeBackend(map[string]*fakeRemote{"fake://fake": remote})()
+
+	dir, err := ioutil.TempDir("", "trash-vcs")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	c := &cache{dir: filepath.Join(dir, "cache"), work: filepath.Join(dir, "work"), events: nopListener{}}
+	assert.NoError(os.Mkdir(c.work, 0755))
+
+	for pkg, latest := range map[string]string{
+		"example.com/fake":    "v3.0.0",
+		"example.com/fake/v2": "v2.1.0",
+		"gopkg.in/fake.v1":    "v1.0.0",
+		"example.com/fake/v4": "v4", // the branch, with no tags
+	} {
+		i := conf.Import{Package: pkg, Repo: "fake://fake", VCS: "fake"}
+		version, err := c.latestVersion(i)
+		assert.NoError(err)
+		assert.Equal(latest, version, pkg)
+	}
+
+	i := conf.Import{Package: "example.com/fake/v2", Version: ">=1.0", Repo: "fake://fake", VCS: "fake"}
+	tag, err := c.resolveTag(i)
+	assert.NoError(err)
+	assert.Equal("v2.1.0", tag)
+
+	// the module is in the v3 dir of the repo
+	i = conf.Import{Package: "example.com/fake/v3", Version: "v3.0.0", Repo: "fake://fake", VCS: "fake"}
+	assert.NoError(c.prepare(i))
+	assert.NoError(c.checkout(i))
+	bytes, err := ioutil.ReadFile(filepath.Join(c.repoDir(i.Package), "fake.go"))
+	assert.NoError(err)
+	assert.Equal("package fake // v3\n", string(bytes))
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/util"
+
+	"github.com/pkg/errors"
+)
+
+// ImportDiff is how the vendored files of an import differ from the lock.
+type ImportDiff struct {
+	Package  string // empty for the files that belong to no import
+	Reason   string
+	Modified []string
+	Missing  []string
+	Extra    []string
+}
+
+// OK tells whether the files of the import match the lock.
+func (d ImportDiff) OK() bool {
+	return d.Reason == "" && len(d.Modified)+len(d.Missing)+len(d.Extra) == 0
+}
+
+// Verify checks that the target dir is exactly what the lock says it is,
+// returning how every locked import differs from it, if at all. The files
+// of the imports which don't match are compared with the trees of their
+// locked commits in the cache, which is never fetched into.
+func Verify(opts Options) ([]ImportDiff, error) {
+	opts, err := opts.resolve()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := conf.ParseLock(filepath.Join(opts.Dir, LockFile))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read %s", LockFile)
+	}
+	opts.Offline = true
+	c, err := openCache(opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	return verifyVendor(opts.TargetDir, lock, func(l conf.LockedImport) (string, error) {
+		return lockedTree(c, l)
+	})
+}
+
+// lockedTree checks l out at its locked commit from the cache, returning
+// the dir of its files.
+func lockedTree(c *cache, l conf.LockedImport) (string, error) {
+	if l.Commit == "" {
+		return "", errors.New("no commit in " + LockFile)
+	}
+	i := conf.Import{Package: l.Package, Version: l.Version, Repo: l.Repo, Commit: l.Commit, Tag: l.Tag}
+	if err := c.prepare(i); err != nil {
+		return "", err
+	}
+	if err := c.checkout(i); err != nil {
+		return "", err
+	}
+	return c.repoDir(l.Package), nil
+}
+
+// verifyVendor recomputes the tree hash of every locked import in vendorDir
+// and, where it doesn't match, lists the files that differ from the tree of
+// the import that locked returns. Files that belong to no import at all are
+// reported under an empty package name.
+func verifyVendor(vendorDir string, lock *conf.Lock, locked func(l conf.LockedImport) (string, error)) ([]ImportDiff, error) {
+	imports := make([]conf.Import, 0, len(lock.Imports))
+	for _, i := range lock.Imports {
+		imports = append(imports, conf.Import{Package: i.Package})
+	}
+
+	var diffs []ImportDiff
+	for _, i := range lock.Imports {
+		d := ImportDiff{Package: i.Package}
+		pth := path.Join(vendorDir, i.Package)
+		files, err := util.HashFiles(pth, nestedImports(i.Package, imports))
+		switch {
+		case os.IsNotExist(err):
+			d.Reason = "not vendored"
+			diffs = append(diffs, d)
+			continue
+		case err != nil:
+			return nil, err
+		}
+
+		switch {
+		case i.Hash == "":
+			d.Reason = "no hash in " + LockFile + ", re-run trash"
+		case util.TreeHash(files) == i.Hash:
+		default:
+			d.Reason = "hash mismatch"
+			expected, err := vendoredFiles(locked, i, pth, imports)
+			if err != nil {
+				d.Reason += fmt.Sprintf(" (can't tell which files changed: %v)", err)
+				break
+			}
+			d.Modified, d.Missing, d.Extra = diffFiles(expected, files)
+		}
+		diffs = append(diffs, d)
+	}
+
+	stray, err := strayFiles(vendorDir, imports)
+	if err != nil {
+		return nil, err
+	}
+	if len(stray) > 0 {
+		diffs = append(diffs, ImportDiff{Reason: "not part of any import", Extra: stray})
+	}
+	return diffs, nil
+}
+
+// vendoredFiles hashes the files of the tree of l that vendoring keeps in
+// pkgDir: pruning drops the tests and the dirs of the packages nobody
+// imports, so only the files of the dirs which are in pkgDir count.
+func vendoredFiles(locked func(l conf.LockedImport) (string, error), l conf.LockedImport, pkgDir string, imports []conf.Import) (map[string]string, error) {
+	tree, err := locked(l)
+	if err != nil {
+		return nil, err
+	}
+	files, err := util.HashFiles(tree, nestedImports(l.Package, imports))
+	if err != nil {
+		return nil, err
+	}
+	for f := range files {
+		if strings.HasSuffix(f, "_test.go") {
+			delete(files, f)
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(pkgDir, filepath.FromSlash(path.Dir(f)))); err != nil || !info.IsDir() {
+			delete(files, f)
+		}
+	}
+	return files, nil
+}
+
+func diffFiles(expected, actual map[string]string) (modified, missing, extra []string) {
+	for f, h := range expected {
+		switch a, ok := actual[f]; {
+		case !ok:
+			missing = append(missing, f)
+		case a != h:
+			modified = append(modified, f)
+		}
+	}
+	for f := range actual {
+		if _, ok := expected[f]; !ok {
+			extra = append(extra, f)
+		}
+	}
+	sort.Strings(modified)
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return
+}
+
+// strayFiles lists the files in vendorDir outside of every import dir.
+func strayFiles(vendorDir string, imports []conf.Import) ([]string, error) {
+	owned := map[string]bool{}
+	for _, i := range imports {
+		owned[i.Package] = true
+	}
+	var stray []string
+	err := filepath.Walk(vendorDir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if p == vendorDir {
+			return nil
+		}
+		rel := filepath.ToSlash(p[len(vendorDir)+1:])
+		if info.IsDir() {
+			if owned[rel] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if rel != "modules.txt" && !strings.HasPrefix(rel, ".") {
+			stray = append(stray, rel)
+		}
+		return nil
+	})
+	return stray, err
+}
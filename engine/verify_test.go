@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyVendor(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-verify")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	vendorDir, trees := filepath.Join(dir, "vendor"), filepath.Join(dir, "trees")
+
+	write := func(root, name, content string) {
+		p := filepath.Join(root, name)
+		assert.NoError(os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	write(vendorDir, "github.com/pkg/errors/errors.go", "package errors\n")
+	write(vendorDir, "github.com/pkg/errors/stack.go", "package errors\n")
+	write(vendorDir, "golang.org/x/sys/unix/unix.go", "package unix\n")
+	write(vendorDir, "modules.txt", "")
+
+	// the trees in the cache have what pruning removed too
+	write(trees, "github.com/pkg/errors/errors.go", "package errors\n")
+	write(trees, "github.com/pkg/errors/stack.go", "package errors\n")
+	write(trees, "github.com/pkg/errors/errors_test.go", "package errors\n")
+	write(trees, "github.com/pkg/errors/unused/unused.go", "package unused\n")
+	locked := func(l conf.LockedImport) (string, error) {
+		if l.Package != "github.com/pkg/errors" {
+			return "", errors.New("not in the cache")
+		}
+		return filepath.Join(trees, l.Package), nil
+	}
+
+	lock := &conf.Lock{}
+	for _, pkg := range []string{"github.com/pkg/errors", "golang.org/x/sys"} {
+		hash, err := util.HashDir(filepath.Join(vendorDir, pkg), nil)
+		assert.NoError(err)
+		lock.Imports = append(lock.Imports, conf.LockedImport{Package: pkg, Hash: hash})
+	}
+
+	diffs, err := verifyVendor(vendorDir, lock, locked)
+	assert.NoError(err)
+	assert.Len(diffs, 2)
+	for _, d := range diffs {
+		assert.True(d.OK(), d.Package)
+	}
+
+	write(vendorDir, "github.com/pkg/errors/errors.go", "package errors // changed\n")
+	assert.NoError(os.Remove(filepath.Join(vendorDir, "github.com/pkg/errors/stack.go")))
+	write(vendorDir, "github.com/pkg/errors/extra.go", "package errors\n")
+	write(vendorDir, "github.com/other/thing/thing.go", "package thing\n")
+	write(vendorDir, "golang.org/x/sys/unix/unix.go", "package unix // changed\n")
+
+	diffs, err = verifyVendor(vendorDir, lock, locked)
+	assert.NoError(err)
+	assert.Len(diffs, 3)
+	assert.Equal(ImportDiff{
+		Package:  "github.com/pkg/errors",
+		Reason:   "hash mismatch",
+		Modified: []string{"errors.go"},
+		Missing:  []string{"stack.go"},
+		Extra:    []string{"extra.go"},
+	}, diffs[0])
+	assert.Equal("hash mismatch (can't tell which files changed: not in the cache)", diffs[1].Reason)
+	assert.Empty(diffs[1].Modified)
+	assert.Equal([]string{"github.com/other/thing/thing.go"}, diffs[2].Extra)
+
+	assert.NoError(os.RemoveAll(filepath.Join(vendorDir, "golang.org")))
+	diffs, err = verifyVendor(vendorDir, lock, locked)
+	assert.NoError(err)
+	assert.Equal("not vendored", diffs[1].Reason)
+}
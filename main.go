@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/rdeusser/trash/conf"
+	"github.com/rdeusser/trash/engine"
+	"github.com/rdeusser/trash/util"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var Version = "v0.3.0-dev"
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "trash"
+	app.Version = Version
+	app.Author = "@imikushin, @ibuildthecloud"
+	app.Usage = "Vendor imported packages and throw away the trash!"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Usage: "Vendored packages list",
+			Value: "vendor.conf",
+		},
+		cli.StringFlag{
+			Name:  "directory, C",
+			Usage: "The directory in which to run, --file is relative to this",
+			Value: ".",
+		},
+		cli.StringFlag{
+			Name:  "target, T",
+			Usage: "The directory to store results",
+			Value: "vendor",
+		},
+		cli.BoolFlag{
+			Name:  "keep, k",
+			Usage: "Keep all downloaded vendor code",
+		},
+		cli.BoolFlag{
+			Name:  "update, u",
+			Usage: "Update all packages",
+		},
+		cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "Look up import paths over http when https fails",
+		},
+		cli.BoolFlag{
+			Name:  "debug, d",
+			Usage: "Debug logging",
+		},
+		cli.StringFlag{
+			Name:   "cache",
+			Usage:  "Cache directory",
+			Value:  path.Join(os.Getenv("HOME"), ".trash-cache"),
+			EnvVar: "TRASH_CACHE",
+		},
+		cli.StringFlag{
+			Name:   "mirrors",
+			Usage:  "Mirrors file, mapping import path or URL prefixes to the URLs to fetch them from",
+			Value:  path.Join(os.Getenv("HOME"), ".trash-mirrors.yaml"),
+			EnvVar: "TRASH_MIRRORS",
+		},
+		cli.StringFlag{
+			Name:   "gopath",
+			Hidden: true,
+			EnvVar: "GOPATH",
+		},
+		cli.BoolFlag{
+			Name:  "include-vendor",
+			Usage: "Whether to include vendor when running trash -k",
+		},
+		cli.BoolFlag{
+			Name:  "modules, m",
+			Usage: "Write go.mod and <target>/modules.txt, for `go build -mod=vendor`",
+		},
+		cli.IntFlag{
+			Name:  "jobs, j",
+			Usage: "How many repos to fetch and check out at the same time",
+			Value: 8,
+		},
+		cli.BoolFlag{
+			Name:   "offline",
+			Usage:  "Get everything from the cache, never from the network",
+			EnvVar: "TRASH_OFFLINE",
+		},
+		cli.StringFlag{
+			Name:   "proxy",
+			Usage:  "Get the imports without a repo or vcs from this GOPROXY (https:// or file://) instead of their repos",
+			EnvVar: "TRASH_PROXY",
+		},
+		cli.GenericFlag{
+			Name:  "copy",
+			Usage: "How to copy files from the cache: copy, hardlink (don't edit the vendored files then) or reflink",
+			Value: new(util.CopyMode),
+		},
+	}
+	app.Action = runWrapper
+	app.Commands = []cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "Check that the target directory matches the hashes in trash.lock",
+			Action: verifyCommand,
+		},
+		{
+			Name:      "update",
+			Usage:     "Update only the given packages, to their latest tag or to @version",
+			ArgsUsage: "<package>[@<version>]...",
+			Action:    updateCommand,
+		},
+		{
+			Name:      "add",
+			Usage:     "Add a package to the conf file and vendor it, at its latest tag or at @version",
+			ArgsUsage: "<package>[@<version>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "repo",
+					Usage: "Fetch the package from this repo URL",
+				},
+				cli.BoolFlag{
+					Name:  "transitive",
+					Usage: "Vendor the dependencies of the package too",
+				},
+			},
+			Action: addCommand,
+		},
+		{
+			Name:      "remove",
+			Usage:     "Remove packages from the conf file and the target directory",
+			ArgsUsage: "<package>...",
+			Action:    removeCommand,
+		},
+		{
+			Name:  "outdated",
+			Usage: "Show the newer versions available for every import",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the report as JSON",
+				},
+			},
+			Action: outdatedCommand,
+		},
+		{
+			Name:   "check",
+			Usage:  "Vendor into a temporary directory and report how the target directory differs from it",
+			Action: checkCommand,
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		if errors.Cause(err) == engine.ErrInterrupted {
+			os.Exit(130)
+		}
+		os.Exit(1)
+	}
+}
+
+// interrupt returns a channel which is closed on SIGINT or SIGTERM, for the
+// engine to stop and leave everything as it was. A second one kills trash.
+func interrupt() <-chan struct{} {
+	cancel := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		logrus.Warnf("Got %v: stopping", sig)
+		close(cancel)
+	}()
+	return cancel
+}
+
+func runWrapper(ctx *cli.Context) error {
+	if err := run(ctx); err != nil {
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
+func newOptions(c *cli.Context) engine.Options {
+	if c.GlobalBool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+	return engine.Options{
+		Dir:           c.GlobalString("directory"),
+		ConfFile:      c.GlobalString("file"),
+		TargetDir:     c.GlobalString("target"),
+		CacheDir:      c.GlobalString("cache"),
+		MirrorsFile:   c.GlobalString("mirrors"),
+		Keep:          c.GlobalBool("keep"),
+		Insecure:      c.GlobalBool("insecure"),
+		IncludeVendor: c.GlobalBool("include-vendor"),
+		Modules:       c.GlobalBool("modules"),
+		Jobs:          c.GlobalInt("jobs"),
+		CopyMode:      *c.GlobalGeneric("copy").(*util.CopyMode),
+		Offline:       c.GlobalBool("offline"),
+		Proxy:         c.GlobalString("proxy"),
+		GOPATH:        c.GlobalString("gopath"),
+		Cancel:        interrupt(),
+	}
+}
+
+func run(c *cli.Context) error {
+	if c.GlobalBool("update") {
+		return engine.Update(newOptions(c))
+	}
+	return engine.Vendor(newOptions(c))
+}
+
+// updateCommand updates just the imports named on the command line, as
+// `pkg` (to the latest tag) or `pkg@version`.
+func updateCommand(c *cli.Context) error {
+	if !c.Args().Present() {
+		return cli.NewExitError("Which packages? Usage: trash update <package>[@<version>]...", 2)
+	}
+	if err := engine.UpdatePackages(newOptions(c), c.Args()); err != nil {
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
+// addCommand adds a package to the conf file and vendors just that package
+// (and its dependencies, with --transitive).
+func addCommand(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("Which package? Usage: trash add <package>[@<version>] [--repo <url>] [--transitive]", 2)
+	}
+	pkg, version := c.Args().First(), ""
+	if at := strings.LastIndex(pkg, "@"); at > 0 {
+		pkg, version = pkg[:at], pkg[at+1:]
+	}
+	i := conf.Import{
+		Package: pkg,
+		Version: version,
+		Repo:    c.String("repo"),
+		Options: conf.Options{Transitive: c.Bool("transitive")},
+	}
+	if err := engine.Add(newOptions(c), i); err != nil {
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
+// removeCommand removes packages from the conf file and from the target dir.
+func removeCommand(c *cli.Context) error {
+	if !c.Args().Present() {
+		return cli.NewExitError("Which packages? Usage: trash remove <package>...", 2)
+	}
+	if err := engine.Remove(newOptions(c), c.Args()); err != nil {
+		logrus.Error(err)
+		return err
+	}
+	return nil
+}
+
+func verifyCommand(c *cli.Context) error {
+	targetDir := c.GlobalString("target")
+	diffs, err := engine.Verify(newOptions(c))
+	if errors.Cause(err) == engine.ErrInterrupted {
+		return err
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	failed := 0
+	for _, d := range diffs {
+		if d.OK() {
+			logrus.Debugf("'%s' is fine", d.Package)
+			continue
+		}
+		failed++
+		name := d.Package
+		if name == "" {
+			name = targetDir
+		}
+		fmt.Printf("%s: %s\n", name, d.Reason)
+		for _, f := range d.Modified {
+			fmt.Printf("  modified: %s\n", f)
+		}
+		for _, f := range d.Missing {
+			fmt.Printf("  missing:  %s\n", f)
+		}
+		for _, f := range d.Extra {
+			fmt.Printf("  extra:    %s\n", f)
+		}
+	}
+	if failed > 0 {
+		return cli.NewExitError(fmt.Sprintf("%s does not match %s", targetDir, engine.LockFile), 1)
+	}
+	logrus.Infof("%s matches %s", targetDir, engine.LockFile)
+	return nil
+}
+
+// checkCommand vendors into a scratch dir and lists how the target dir,
+// trash.lock and (with --modules) go.mod differ from the result.
+func checkCommand(c *cli.Context) error {
+	if c.GlobalBool("update") || c.GlobalBool("keep") {
+		return cli.NewExitError("check can't be combined with --update or --keep", 2)
+	}
+	targetDir := c.GlobalString("target")
+	changes, err := engine.Check(newOptions(c))
+	if errors.Cause(err) == engine.ErrInterrupted {
+		return err
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	if len(changes) > 0 {
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		return cli.NewExitError(fmt.Sprintf("%s is out of date with %s: run trash", targetDir, c.GlobalString("file")), 1)
+	}
+	logrus.Infof("%s is up to date", targetDir)
+	return nil
+}
+
+// outdatedCommand reports, for every import, the newer tags its repo has and
+// how far behind the imports following a branch are.
+func outdatedCommand(c *cli.Context) error {
+	report, err := engine.Outdated(newOptions(c))
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	if c.Bool("json") {
+		return writeOutdatedJSON(os.Stdout, report)
+	}
+	return writeOutdatedTable(os.Stdout, report)
+}
+
+func writeOutdatedJSON(w io.Writer, report []engine.OutdatedImport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func writeOutdatedTable(w io.Writer, report []engine.OutdatedImport) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PACKAGE\tVERSION\tPATCH\tMINOR\tMAJOR\tBEHIND")
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	for _, o := range report {
+		version := o.Version
+		if o.Tag != "" {
+			version += " (" + o.Tag + ")"
+		}
+		behind := ""
+		if o.Behind != nil {
+			behind = strconv.Itoa(*o.Behind)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", o.Package, orDash(version), orDash(o.LatestPatch), orDash(o.LatestMinor), orDash(o.LatestMajor), orDash(behind))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rdeusser/trash/engine"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteOutdated(t *testing.T) {
+	assert := require.New(t)
+
+	behind := 3
+	report := []engine.OutdatedImport{
+		{Package: "github.com/pkg/errors", Version: "v0.8.1", LatestPatch: "v0.8.1", LatestMinor: "v0.9.1", LatestMajor: "v0.9.1"},
+		{Package: "golang.org/x/sys", Version: "master", Behind: &behind},
+	}
+
+	var table bytes.Buffer
+	assert.NoError(writeOutdatedTable(&table, report))
+	assert.Equal(`PACKAGE                VERSION  PATCH   MINOR   MAJOR   BEHIND
+github.com/pkg/errors  v0.8.1   v0.8.1  v0.9.1  v0.9.1  -
+golang.org/x/sys       master   -       -       -       3
+`, table.String())
+
+	var js bytes.Buffer
+	assert.NoError(writeOutdatedJSON(&js, report))
+	assert.JSONEq(`[
+		{"package": "github.com/pkg/errors", "version": "v0.8.1", "latestPatch": "v0.8.1", "latestMinor": "v0.9.1", "latestMajor": "v0.9.1"},
+		{"package": "golang.org/x/sys", "version": "master", "behind": 3}
+	]`, js.String())
+}
@@ -0,0 +1,181 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CopyMode is how CopyTree makes the files of the copy.
+type CopyMode int
+
+const (
+	// Copy copies the contents of the files.
+	Copy CopyMode = iota
+	// Hardlink links the files of the copy to the originals, which must not
+	// change afterwards, copying them where that's not possible.
+	Hardlink
+	// Reflink clones the files, sharing their blocks until either is
+	// changed, where the filesystem supports it, and copies them elsewhere.
+	Reflink
+)
+
+var copyModes = []string{"copy", "hardlink", "reflink"}
+
+func (m CopyMode) String() string {
+	if int(m) < len(copyModes) {
+		return copyModes[m]
+	}
+	return fmt.Sprintf("CopyMode(%d)", int(m))
+}
+
+// ParseCopyMode returns the CopyMode called s: "copy", "hardlink" or "reflink".
+func ParseCopyMode(s string) (CopyMode, error) {
+	for k, name := range copyModes {
+		if s == name {
+			return CopyMode(k), nil
+		}
+	}
+	return Copy, fmt.Errorf("unknown copy mode '%s': use one of %v", s, copyModes)
+}
+
+// Set sets m to the CopyMode called s, so that it can be a flag.
+func (m *CopyMode) Set(s string) error {
+	mode, err := ParseCopyMode(s)
+	if err == nil {
+		*m = mode
+	}
+	return err
+}
+
+// CopyTree copies the tree at src into dst, which is created if needed;
+// what's in dst already is overwritten or left alone, like `cp -a src/. dst`.
+// Permissions and modification times are kept, symlinks are copied as they
+// are, without being followed, and anything which is neither a dir, a
+// regular file nor a symlink is skipped. Files in dst are replaced, never
+// written to, so that hardlinks never change the originals.
+func CopyTree(src, dst string, mode CopyMode) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	type dir struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dir
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if err := mkdir(target); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir{target, info})
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := remove(target); err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			if err := remove(target); err != nil {
+				return err
+			}
+			return copyFile(path, target, info, mode)
+		default:
+			logrus.Warnf("Not copying '%s': it's not a regular file (%s)", path, info.Mode())
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// dirs get their permissions last, so that read-only ones can be filled
+	for k := len(dirs) - 1; k >= 0; k-- {
+		d := dirs[k]
+		if err := os.Chmod(d.path, d.info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.path, d.info.ModTime(), d.info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mkdir makes sure there's a dir at path, writable while it's being filled.
+func mkdir(path string) error {
+	if info, err := os.Lstat(path); err == nil && !info.IsDir() {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0755)
+}
+
+// remove removes what's at path, unless it's a dir or there's nothing there.
+func remove(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("'%s' is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+func copyFile(src, dst string, info os.FileInfo, mode CopyMode) error {
+	switch mode {
+	case Hardlink:
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	case Reflink:
+		if err := reflink(src, dst, info); err == nil {
+			return nil
+		}
+		os.Remove(dst)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
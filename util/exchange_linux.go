@@ -0,0 +1,27 @@
+package util
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Exchange swaps the files or dirs at a and b, which both have to be there,
+// in one step: with renameat2(RENAME_EXCHANGE), which Linux has since 3.15
+// and most of its filesystems support.
+func Exchange(a, b string) error {
+	pa, err := unix.BytePtrFromString(a)
+	if err != nil {
+		return err
+	}
+	pb, err := unix.BytePtrFromString(b)
+	if err != nil {
+		return err
+	}
+	cwd := unix.AT_FDCWD
+	if _, _, errno := unix.Syscall6(unix.SYS_RENAMEAT2, uintptr(cwd), uintptr(unsafe.Pointer(pa)), uintptr(cwd), uintptr(unsafe.Pointer(pb)), unix.RENAME_EXCHANGE, 0); errno != 0 {
+		return &os.LinkError{Op: "exchange", Old: a, New: b, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import (
+	"errors"
+)
+
+// Exchange isn't supported here: files are moved aside and back instead.
+func Exchange(a, b string) error {
+	return errors.New("exchanging files is not supported on this platform")
+}
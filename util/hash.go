@@ -0,0 +1,95 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// HashFiles returns the sha256 of every file under dir, keyed by slash
+// separated path relative to dir. Symlinks are hashed by their target.
+// Directories for which skip returns true are left out.
+func HashFiles(dir string, skip func(rel string) bool) (map[string]string, error) {
+	r := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if skip != nil && skip(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		sum, err := HashFile(path, info)
+		if err != nil || sum == "" {
+			return err
+		}
+		r[rel] = sum
+		return nil
+	})
+	return r, err
+}
+
+// HashFile returns the sha256 of a regular file or the target of a symlink,
+// and "" for anything else.
+func HashFile(path string, info os.FileInfo) (string, error) {
+	h := sha256.New()
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(h, "symlink:"+filepath.ToSlash(target))
+	case info.Mode().IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return "", err
+		}
+	default:
+		return "", nil
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// TreeHash combines file hashes into one, in the "h1:" format of go.sum.
+func TreeHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s  %s\n", files[name], name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// HashDir is TreeHash of HashFiles.
+func HashDir(dir string, skip func(rel string) bool) (string, error) {
+	files, err := HashFiles(dir, skip)
+	if err != nil {
+		return "", err
+	}
+	return TreeHash(files), nil
+}
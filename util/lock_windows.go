@@ -0,0 +1,23 @@
+package util
+
+import (
+	"os"
+	"time"
+)
+
+// LockFile waits for an exclusive lock on the file at path, and returns the
+// func releasing the lock. There's no flock(2) here: the lock is the file
+// itself, so one left behind by a killed process has to be removed by hand.
+func LockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink isn't supported here: files are copied instead.
+func reflink(src, dst string, info os.FileInfo) error {
+	return errors.New("reflinks are not supported on this platform")
+}
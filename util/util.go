@@ -31,9 +31,16 @@ func CmdOutLines(cmd *exec.Cmd) <-chan string {
 	r := make(chan string, 1000)
 	out, err := cmd.StdoutPipe()
 	if err != nil {
-		logrus.Fatalf("Could not obtain stdout of `%s`: %s", strings.Join(cmd.Args, " "), err)
+		logrus.Errorf("Could not obtain stdout of `%s`: %s", strings.Join(cmd.Args, " "), err)
+		close(r)
+		return r
 	}
 	scanner := bufio.NewScanner(out)
+	if err := cmd.Start(); err != nil {
+		logrus.Errorf("Could not start `%s`: %s", strings.Join(cmd.Args, " "), err)
+		close(r)
+		return r
+	}
 	go func() {
 		defer close(r)
 		defer out.Close()
@@ -42,9 +49,6 @@ func CmdOutLines(cmd *exec.Cmd) <-chan string {
 			r <- scanner.Text()
 		}
 	}()
-	if err := cmd.Start(); err != nil {
-		logrus.Fatalf("Could not start `%s`: %s", strings.Join(cmd.Args, " "), err)
-	}
 	return r
 }
 
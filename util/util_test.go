@@ -1,7 +1,11 @@
 package util
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,3 +21,141 @@ func TestOneMsg(t *testing.T) {
 	s, ok = <-c
 	assert.False(ok)
 }
+
+func TestHashDir(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-hash")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "sub", "nested"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "a.go"), []byte("package a\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "b.go"), []byte("package sub\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "nested", "c.go"), []byte("package nested\n"), 0644))
+	assert.NoError(os.Symlink("a.go", filepath.Join(dir, "link.go")))
+
+	files, err := HashFiles(dir, nil)
+	assert.NoError(err)
+	assert.Len(files, 4)
+	assert.Contains(files, "sub/nested/c.go")
+
+	skipNested := func(rel string) bool { return rel == "sub/nested" }
+	h1, err := HashDir(dir, skipNested)
+	assert.NoError(err)
+	assert.Regexp("^h1:", h1)
+
+	// changes in skipped dirs don't count
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "nested", "c.go"), []byte("package changed\n"), 0644))
+	h2, err := HashDir(dir, skipNested)
+	assert.NoError(err)
+	assert.Equal(h1, h2)
+
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "b.go"), []byte("package changed\n"), 0644))
+	h3, err := HashDir(dir, skipNested)
+	assert.NoError(err)
+	assert.NotEqual(h1, h3)
+}
+
+func TestLockFile(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-lock")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	unlock, err := LockFile(filepath.Join(dir, "repo.lock"))
+	assert.NoError(err)
+
+	locked := make(chan func())
+	go func() {
+		unlock, err := LockFile(filepath.Join(dir, "repo.lock"))
+		assert.NoError(err)
+		locked <- unlock
+	}()
+	select {
+	case <-locked:
+		t.Fatal("got the lock twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	(<-locked)()
+}
+
+func TestCopyTree(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-copy")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	assert.NoError(os.MkdirAll(filepath.Join(src, "sub", "ro"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(src, "a.go"), []byte("package a\n"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(src, "sub", "ro", "b.go"), []byte("package ro\n"), 0444))
+	assert.NoError(os.Symlink("../a.go", filepath.Join(src, "sub", "link.go")))
+	assert.NoError(os.Chmod(filepath.Join(src, "sub", "ro"), 0555))
+	defer os.Chmod(filepath.Join(src, "sub", "ro"), 0755)
+
+	for _, mode := range []CopyMode{Copy, Hardlink, Reflink} {
+		dst := filepath.Join(dir, mode.String())
+		assert.NoError(ioutil.WriteFile(filepath.Join(dir, "stale"), []byte("stale\n"), 0644))
+		assert.NoError(os.MkdirAll(dst, 0755))
+		assert.NoError(os.Symlink("../stale", filepath.Join(dst, "a.go")))
+
+		assert.NoError(CopyTree(src, dst, mode), mode.String())
+		bytes, err := ioutil.ReadFile(filepath.Join(dst, "a.go"))
+		assert.NoError(err)
+		assert.Equal("package a\n", string(bytes), "a symlink in dst is replaced, not followed")
+		bytes, err = ioutil.ReadFile(filepath.Join(dir, "stale"))
+		assert.NoError(err)
+		assert.Equal("stale\n", string(bytes))
+
+		info, err := os.Stat(filepath.Join(dst, "run.sh"))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0755), info.Mode().Perm())
+		info, err = os.Stat(filepath.Join(dst, "sub", "ro"))
+		assert.NoError(err)
+		assert.Equal(os.FileMode(0555), info.Mode().Perm())
+		link, err := os.Readlink(filepath.Join(dst, "sub", "link.go"))
+		assert.NoError(err)
+		assert.Equal("../a.go", link)
+
+		srcInfo, err := os.Stat(filepath.Join(src, "a.go"))
+		assert.NoError(err)
+		info, err = os.Stat(filepath.Join(dst, "a.go"))
+		assert.NoError(err)
+		assert.Equal(mode == Hardlink, os.SameFile(srcInfo, info), mode.String())
+
+		// copying again over the copy works, read-only dirs and all
+		assert.NoError(CopyTree(src, dst, mode), mode.String())
+		assert.NoError(os.Chmod(filepath.Join(dst, "sub", "ro"), 0755))
+	}
+
+	mode, err := ParseCopyMode("hardlink")
+	assert.NoError(err)
+	assert.Equal(Hardlink, mode)
+	_, err = ParseCopyMode("symlink")
+	assert.Error(err)
+}
+
+func TestExchange(t *testing.T) {
+	assert := require.New(t)
+
+	dir, err := ioutil.TempDir("", "trash-exchange")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	assert.NoError(os.MkdirAll(filepath.Join(a, "sub"), 0755))
+	assert.NoError(ioutil.WriteFile(b, []byte("b"), 0644))
+	if err := Exchange(a, b); err != nil {
+		t.Skipf("no exchange here: %v", err)
+	}
+	assert.DirExists(filepath.Join(b, "sub"))
+	data, err := ioutil.ReadFile(a)
+	assert.NoError(err)
+	assert.Equal("b", string(data))
+	assert.Error(Exchange(a, filepath.Join(dir, "missing")))
+}